@@ -0,0 +1,34 @@
+// Package clock defines the clock that schedules the timers of transactions
+// and the packet deliveries of the simulated network, so that tests can
+// replace it with Fake and control time.
+package clock
+
+import "time"
+
+// Clock tells the time and schedules functions.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function scheduled with Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the function from running. It returns false if the
+	// function has already run or been stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+// Real returns a clock backed by the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
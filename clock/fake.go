@@ -0,0 +1,122 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Fake is a clock that only moves when Advance is called. Scheduled
+// functions run synchronously in Advance, in the order of their due time.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers fakeTimers
+}
+
+// NewFake returns a fake clock that starts at start.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// AfterFunc schedules f to run when the clock has advanced by d. A function
+// with a non-positive duration runs at the next call to Advance.
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	t := &fakeTimer{clock: c, when: c.now.Add(d), seq: c.seq, f: f, index: -1}
+	heap.Push(&c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the functions that become due,
+// including functions scheduled by them within the same period.
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+
+	for len(c.timers) > 0 && !c.timers[0].when.After(end) {
+		t := heap.Pop(&c.timers).(*fakeTimer)
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Pending returns the number of scheduled functions that have not run.
+func (c *Fake) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *Fake
+	when  time.Time
+	seq   uint64
+	f     func()
+	index int
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+// fakeTimers is a heap of timers ordered by due time, and by the order they
+// were scheduled for timers due at the same time.
+type fakeTimers []*fakeTimer
+
+func (h fakeTimers) Len() int { return len(h) }
+
+func (h fakeTimers) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h fakeTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *fakeTimers) Push(x any) {
+	t := x.(*fakeTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *fakeTimers) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,32 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFake(t *testing.T) {
+	c := NewFake(epoch)
+
+	var fired []int
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	c.AfterFunc(time.Second, func() {
+		fired = append(fired, 1)
+		c.AfterFunc(500*time.Millisecond, func() { fired = append(fired, 3) })
+	})
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, 4) })
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	c.Advance(time.Second)
+	assert.Equal(t, []int{1}, fired)
+	assert.Equal(t, epoch.Add(time.Second), c.Now())
+
+	c.Advance(time.Second)
+	assert.Equal(t, []int{1, 3, 2}, fired)
+	assert.Equal(t, 0, c.Pending())
+}
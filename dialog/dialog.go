@@ -0,0 +1,443 @@
+// Package dialog implements SIP dialogs as described in RFC 3261 section 12:
+// the peer-to-peer relationship between two user agents that persists for
+// some time, identified by the Call-ID and the tags of both sides.
+package dialog
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+var (
+	ErrNotDialogForming = errors.New("dialog: response does not create a dialog")
+	ErrNoTag            = errors.New("dialog: response has no To tag")
+	ErrNoContact        = errors.New("dialog: message has no Contact header")
+	ErrMissingHeader    = errors.New("dialog: message lacks From, To, Call-ID or CSeq")
+)
+
+// ID identifies a dialog from the perspective of one user agent.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-12
+type ID struct {
+	CallID    string
+	LocalTag  string
+	RemoteTag string
+}
+
+func (id ID) String() string {
+	return id.CallID + ";local-tag=" + id.LocalTag + ";remote-tag=" + id.RemoteTag
+}
+
+// RequestID returns the ID of the dialog that a received request belongs
+// to. The To tag of the request is the local tag.
+func RequestID(req sip.Message) (ID, error) {
+	from, to, callID, err := identity(req)
+	if err != nil {
+		return ID{}, err
+	}
+	return ID{CallID: callID, LocalTag: to.Tag, RemoteTag: from.Tag}, nil
+}
+
+// ResponseID returns the ID of the dialog that a received response belongs
+// to. The From tag of the response is the local tag.
+func ResponseID(res sip.Message) (ID, error) {
+	from, to, callID, err := identity(res)
+	if err != nil {
+		return ID{}, err
+	}
+	return ID{CallID: callID, LocalTag: from.Tag, RemoteTag: to.Tag}, nil
+}
+
+func identity(msg sip.Message) (*sip.From, *sip.To, string, error) {
+	from, ok := msg.From()
+	if !ok {
+		return nil, nil, "", ErrMissingHeader
+	}
+	to, ok := msg.To()
+	if !ok {
+		return nil, nil, "", ErrMissingHeader
+	}
+	callID, ok := msg.CallID()
+	if !ok {
+		return nil, nil, "", ErrMissingHeader
+	}
+	return from, to, string(*callID), nil
+}
+
+// State is the state of a dialog.
+type State int
+
+const (
+	// StateEarly is the state of a dialog created by a provisional response.
+	StateEarly State = iota
+	// StateConfirmed is the state of a dialog created or confirmed by a 2xx
+	// response.
+	StateConfirmed
+	StateTerminated
+)
+
+func (s State) String() string {
+	switch s {
+	case StateEarly:
+		return "Early"
+	case StateConfirmed:
+		return "Confirmed"
+	case StateTerminated:
+		return "Terminated"
+	}
+	return "Unknown"
+}
+
+// Dialog holds the state of a dialog. It is safe for concurrent use.
+type Dialog struct {
+	mu sync.Mutex
+
+	id    ID
+	state State
+	uac   bool
+	// origin is the CSeq of the request that created the dialog.
+	origin sip.CSeq
+
+	// local and remote are the From and To header fields of requests sent
+	// within the dialog, including the tags.
+	local  sip.From
+	remote sip.To
+
+	localSeq  uint32
+	remoteSeq uint32
+	// remoteSeqSet is unset until a request from the peer has been seen,
+	// since the remote sequence number of a UAC dialog starts out empty.
+	remoteSeqSet bool
+
+	// localTarget is the Contact of requests sent within the dialog. It is
+	// nil if the message that created the dialog had none.
+	localTarget  *sip.Contact
+	remoteTarget sip.URI
+	routeSet     []string
+	secure       bool
+}
+
+// NewUAC creates the dialog of the user agent client that sent req, from res,
+// a provisional response with a To tag or a 2xx response to it. The route set
+// is the Record-Route of the response in reverse order.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-12.1.2
+func NewUAC(req, res sip.Message) (*Dialog, error) {
+	code := res.StatusCode()
+	if code <= 100 || code >= 300 {
+		return nil, ErrNotDialogForming
+	}
+	from, to, callID, err := identity(res)
+	if err != nil {
+		return nil, err
+	}
+	if to.Tag == "" {
+		return nil, ErrNoTag
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return nil, ErrMissingHeader
+	}
+	target, err := contactURI(res)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := recordRoutes(res)
+	for i, j := 0, len(routes)-1; i < j; i, j = i+1, j-1 {
+		routes[i], routes[j] = routes[j], routes[i]
+	}
+
+	d := &Dialog{
+		id:           ID{CallID: callID, LocalTag: from.Tag, RemoteTag: to.Tag},
+		state:        StateEarly,
+		uac:          true,
+		local:        *from,
+		remote:       *to,
+		origin:       *cseq,
+		localSeq:     cseq.Sequence,
+		localTarget:  contact(req),
+		remoteTarget: target,
+		routeSet:     routes,
+		secure:       isSecure(req),
+	}
+	if code >= 200 {
+		d.state = StateConfirmed
+	}
+	return d, nil
+}
+
+// NewUAS creates the dialog of the user agent server that received req and
+// answers it with res, a provisional response with a To tag or a 2xx
+// response. The route set is the Record-Route of the request in order.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-12.1.1
+func NewUAS(req, res sip.Message) (*Dialog, error) {
+	code := res.StatusCode()
+	if code <= 100 || code >= 300 {
+		return nil, ErrNotDialogForming
+	}
+	from, _, callID, err := identity(req)
+	if err != nil {
+		return nil, err
+	}
+	to, ok := res.To()
+	if !ok {
+		return nil, ErrMissingHeader
+	}
+	if to.Tag == "" {
+		return nil, ErrNoTag
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return nil, ErrMissingHeader
+	}
+	target, err := contactURI(req)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dialog{
+		id:    ID{CallID: callID, LocalTag: to.Tag, RemoteTag: from.Tag},
+		state: StateEarly,
+		local: sip.From{
+			Scheme:      to.Scheme,
+			DisplayName: to.DisplayName,
+			User:        to.User,
+			Host:        to.Host,
+			Port:        to.Port,
+			Tag:         to.Tag,
+			UserType:    to.UserType,
+		},
+		remote: sip.To{
+			Scheme:      from.Scheme,
+			DisplayName: from.DisplayName,
+			User:        from.User,
+			Host:        from.Host,
+			Port:        from.Port,
+			Tag:         from.Tag,
+			UserType:    from.UserType,
+		},
+		origin:       *cseq,
+		remoteSeq:    cseq.Sequence,
+		remoteSeqSet: true,
+		localTarget:  contact(res),
+		remoteTarget: target,
+		routeSet:     recordRoutes(req),
+		secure:       isSecure(req),
+	}
+	if code >= 200 {
+		d.state = StateConfirmed
+	}
+	return d, nil
+}
+
+// ID returns the ID of the dialog.
+func (d *Dialog) ID() ID {
+	return d.id
+}
+
+// UAC reports whether the dialog was created by sending the request.
+func (d *Dialog) UAC() bool {
+	return d.uac
+}
+
+// State returns the state of the dialog.
+func (d *Dialog) State() State {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.state
+}
+
+// LocalSeq returns the sequence number of the last request sent within the
+// dialog. It is zero if none has been sent.
+func (d *Dialog) LocalSeq() uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.localSeq
+}
+
+// RemoteSeq returns the sequence number of the last request received within
+// the dialog, and false if none has been received.
+func (d *Dialog) RemoteSeq() (uint32, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.remoteSeq, d.remoteSeqSet
+}
+
+// RemoteTarget returns the URI that requests within the dialog are sent to.
+func (d *Dialog) RemoteTarget() sip.URI {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.remoteTarget
+}
+
+// RouteSet returns the Route header field values of requests within the
+// dialog, in the order they are to be visited.
+func (d *Dialog) RouteSet() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]string(nil), d.routeSet...)
+}
+
+// Secure reports whether the dialog was created by a request for a SIPS URI
+// sent over TLS.
+func (d *Dialog) Secure() bool {
+	return d.secure
+}
+
+// Update applies a response received by the UAC to a request within or
+// creating the dialog. A 2xx response to the request that created the dialog
+// confirms an early dialog and recomputes its route set; a 2xx response to a
+// target refresh request updates the remote target. A 300-699 response to
+// the request that created the dialog terminates an early dialog, while a
+// 481 or 408 response to any request terminates the dialog in either state.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-12.2.1.2
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-13.2.2.4
+func (d *Dialog) Update(res sip.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cseq, ok := res.CSeq()
+	if !ok || d.state == StateTerminated {
+		return
+	}
+	origin := *cseq == d.origin
+
+	code := res.StatusCode()
+	switch {
+	case code == sip.StatusCallTransactionDoesNotExist, code == sip.StatusRequestTimeout:
+		d.state = StateTerminated
+	case code >= 300:
+		if d.state == StateEarly && origin {
+			d.state = StateTerminated
+		}
+	case code >= 200:
+		if d.state == StateEarly && origin {
+			if d.uac {
+				routes := recordRoutes(res)
+				for i, j := 0, len(routes)-1; i < j; i, j = i+1, j-1 {
+					routes[i], routes[j] = routes[j], routes[i]
+				}
+				d.routeSet = routes
+			}
+			d.state = StateConfirmed
+		}
+		if isTargetRefresh(cseq.Method) {
+			if target, err := contactURI(res); err == nil {
+				d.remoteTarget = target
+			}
+		}
+	}
+}
+
+// Confirm confirms an early dialog of the UAS once it has sent a 2xx
+// response.
+func (d *Dialog) Confirm() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state == StateEarly {
+		d.state = StateConfirmed
+	}
+}
+
+// Terminate terminates the dialog.
+func (d *Dialog) Terminate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state = StateTerminated
+}
+
+// isTargetRefresh reports whether requests with this method update the
+// remote target of a dialog.
+func isTargetRefresh(method string) bool {
+	switch method {
+	case sip.MethodInvite, sip.MethodUpdate, sip.MethodSubscribe, sip.MethodNotify, sip.MethodRefer:
+		return true
+	}
+	return false
+}
+
+// isSecure reports whether req is for a SIPS URI and was sent or received
+// over TLS, as shown by its top Via.
+func isSecure(req sip.Message) bool {
+	if req.RequestURI().Scheme != "sips" {
+		return false
+	}
+	vias, ok := req.Via()
+	return ok && vias[0].Transport == "tls"
+}
+
+// contact returns a copy of the Contact of msg, or nil if it has none.
+func contact(msg sip.Message) *sip.Contact {
+	c, ok := msg.Contact()
+	if !ok {
+		return nil
+	}
+	cp := *c
+	return &cp
+}
+
+// contactURI returns the URI of the Contact of msg with its parameters, such
+// as maddr and ob, which requests to the remote target have to keep.
+func contactURI(msg sip.Message) (sip.URI, error) {
+	contact, ok := msg.Contact()
+	if !ok || contact.Host == "" {
+		return sip.URI{}, ErrNoContact
+	}
+	return sip.ParseURI(contact.String())
+}
+
+// recordRoutes returns the values of the Record-Route header fields of msg,
+// one per route.
+func recordRoutes(msg sip.Message) []string {
+	var routes []string
+	for _, header := range msg.GetHeaders("record-route") {
+		switch rr := header.(type) {
+		case sip.RecordRoute:
+			routes = append(routes, splitList(string(rr))...)
+		case *sip.RecordRoute:
+			routes = append(routes, splitList(string(*rr))...)
+		}
+	}
+	return routes
+}
+
+// splitList splits a header field value that holds a comma-separated list,
+// ignoring commas within angle brackets and quoted strings.
+func splitList(v string) []string {
+	var (
+		values []string
+		start  int
+		quoted bool
+		angled bool
+	)
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '"' && !angled:
+			quoted = !quoted
+		case c == '<' && !quoted:
+			angled = true
+		case c == '>' && !quoted:
+			angled = false
+		case c == ',' && !quoted && !angled:
+			values = append(values, strings.TrimSpace(v[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(v[start:]); last != "" {
+		values = append(values, last)
+	}
+	return values
+}
@@ -0,0 +1,236 @@
+package dialog
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+func testInvite(t *testing.T) sip.Message {
+	req, err := sip.Parse([]byte("INVITE sips:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TLS pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"Record-Route: <sip:p2.biloxi.com;lr>, <sip:p1.atlanta.com;lr>\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: Bob <sips:bob@biloxi.com>\r\n" +
+		"From: Alice <sips:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Contact: <sips:alice@pc33.atlanta.com>\r\n\r\n"))
+	assert.Nil(t, err)
+	return req
+}
+
+func testResponse(t *testing.T, code int, tag string) sip.Message {
+	res, err := sip.Parse([]byte("SIP/2.0 " + statusLine(code) + "\r\n" +
+		"Via: SIP/2.0/TLS pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"Record-Route: <sip:p2.biloxi.com;lr>\r\n" +
+		"Record-Route: <sip:p1.atlanta.com;lr>\r\n" +
+		"To: Bob <sips:bob@biloxi.com>;tag=" + tag + "\r\n" +
+		"From: Alice <sips:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Contact: <sips:bob@client.biloxi.com:5061>\r\n\r\n"))
+	assert.Nil(t, err)
+	return res
+}
+
+func statusLine(code int) string {
+	switch code {
+	case sip.StatusTrying:
+		return "100 Trying"
+	case sip.StatusRinging:
+		return "180 Ringing"
+	case sip.StatusOK:
+		return "200 OK"
+	case sip.StatusRequestTimeout:
+		return "408 Request Timeout"
+	case sip.StatusCallTransactionDoesNotExist:
+		return "481 Call/Transaction Does Not Exist"
+	}
+	return "486 Busy Here"
+}
+
+func TestNewUAC(t *testing.T) {
+	req := testInvite(t)
+	d, err := NewUAC(req, testResponse(t, sip.StatusRinging, "a6c85cf"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, ID{
+		CallID:    "a84b4c76e66710@pc33.atlanta.com",
+		LocalTag:  "1928301774",
+		RemoteTag: "a6c85cf",
+	}, d.ID())
+	assert.True(t, d.UAC())
+	assert.Equal(t, StateEarly, d.State())
+	assert.Equal(t, uint32(314159), d.LocalSeq())
+	_, ok := d.RemoteSeq()
+	assert.False(t, ok)
+	assert.Equal(t, "bob", d.RemoteTarget().User)
+	assert.Equal(t, "client.biloxi.com", d.RemoteTarget().Host)
+	assert.Equal(t, "5061", d.RemoteTarget().Port)
+	assert.Equal(t, []string{"<sip:p1.atlanta.com;lr>", "<sip:p2.biloxi.com;lr>"}, d.RouteSet())
+	assert.True(t, d.Secure())
+
+	d.Update(testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Equal(t, StateConfirmed, d.State())
+}
+
+func TestNewUACErrors(t *testing.T) {
+	req := testInvite(t)
+	_, err := NewUAC(req, testResponse(t, sip.StatusTrying, "a6c85cf"))
+	assert.Equal(t, ErrNotDialogForming, err)
+	_, err = NewUAC(req, testResponse(t, sip.StatusBusyHere, "a6c85cf"))
+	assert.Equal(t, ErrNotDialogForming, err)
+	_, err = NewUAC(req, testResponse(t, sip.StatusRinging, ""))
+	assert.Equal(t, ErrNoTag, err)
+
+	res := testResponse(t, sip.StatusOK, "a6c85cf")
+	res.RemoveHeader("contact")
+	_, err = NewUAC(req, res)
+	assert.Equal(t, ErrNoContact, err)
+}
+
+func TestEarlyDialogTerminatedByFailure(t *testing.T) {
+	d, err := NewUAC(testInvite(t), testResponse(t, sip.StatusRinging, "a6c85cf"))
+	assert.Nil(t, err)
+
+	d.Update(testResponse(t, sip.StatusBusyHere, "a6c85cf"))
+	assert.Equal(t, StateTerminated, d.State())
+
+	// A terminated dialog stays terminated.
+	d.Update(testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Equal(t, StateTerminated, d.State())
+}
+
+func TestUpdate(t *testing.T) {
+	withCSeq := func(res sip.Message, seq uint32, method string) sip.Message {
+		cseq, _ := res.CSeq()
+		cseq.Sequence, cseq.Method = seq, method
+		return res
+	}
+
+	d, err := NewUAC(testInvite(t), testResponse(t, sip.StatusRinging, "a6c85cf"))
+	assert.Nil(t, err)
+
+	// Only the final response to the INVITE ends the early state.
+	d.Update(withCSeq(testResponse(t, sip.StatusBusyHere, "a6c85cf"), 314160, sip.MethodUpdate))
+	assert.Equal(t, StateEarly, d.State())
+	d.Update(withCSeq(testResponse(t, sip.StatusOK, "a6c85cf"), 314161, sip.MethodPrack))
+	assert.Equal(t, StateEarly, d.State())
+	d.Update(testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Equal(t, StateConfirmed, d.State())
+
+	// Failures of requests within a confirmed dialog leave it alone, except
+	// for 481 and 408.
+	d.Update(withCSeq(testResponse(t, sip.StatusBusyHere, "a6c85cf"), 314162, sip.MethodInvite))
+	assert.Equal(t, StateConfirmed, d.State())
+	d.Update(withCSeq(testResponse(t, sip.StatusCallTransactionDoesNotExist, "a6c85cf"), 314163, sip.MethodInfo))
+	assert.Equal(t, StateTerminated, d.State())
+
+	d, err = NewUAC(testInvite(t), testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Nil(t, err)
+	d.Update(withCSeq(testResponse(t, sip.StatusRequestTimeout, "a6c85cf"), 314160, sip.MethodBye))
+	assert.Equal(t, StateTerminated, d.State())
+}
+
+func TestRemoteTargetParameters(t *testing.T) {
+	res := testResponse(t, sip.StatusOK, "a6c85cf")
+	res.RemoveHeader("contact")
+	res.AppendHeader(&sip.Contact{
+		Scheme:   "sip",
+		User:     "+15551234567",
+		Host:     "edge.biloxi.com",
+		UserType: "phone",
+		Maddr:    "192.0.2.7",
+		LR:       true,
+		Ob:       true,
+	})
+	d, err := NewUAC(testInvite(t), res)
+	assert.Nil(t, err)
+	assert.Equal(t, "sip:+15551234567@edge.biloxi.com;user=phone;maddr=192.0.2.7;lr;ob", d.RemoteTarget().String())
+
+	// Requests within the dialog keep the parameters in the Request-URI.
+	bye, err := d.NewRequest(sip.MethodBye)
+	assert.Nil(t, err)
+	assert.Equal(t, d.RemoteTarget(), bye.RequestURI())
+	assert.True(t, strings.HasPrefix(bye.String(), "BYE sip:+15551234567@edge.biloxi.com;user=phone;maddr=192.0.2.7;lr;ob SIP/2.0\r\n"))
+}
+
+func TestNewUAS(t *testing.T) {
+	req := testInvite(t)
+	d, err := NewUAS(req, testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, ID{
+		CallID:    "a84b4c76e66710@pc33.atlanta.com",
+		LocalTag:  "a6c85cf",
+		RemoteTag: "1928301774",
+	}, d.ID())
+	assert.False(t, d.UAC())
+	assert.Equal(t, StateConfirmed, d.State())
+	assert.Equal(t, uint32(0), d.LocalSeq())
+	seq, ok := d.RemoteSeq()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(314159), seq)
+	assert.Equal(t, "alice", d.RemoteTarget().User)
+	assert.Equal(t, "pc33.atlanta.com", d.RemoteTarget().Host)
+	assert.Equal(t, []string{"<sip:p2.biloxi.com;lr>", "<sip:p1.atlanta.com;lr>"}, d.RouteSet())
+	assert.True(t, d.Secure())
+
+	// The dialog ID matches requests received from the UAC.
+	id, err := ResponseID(testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Nil(t, err)
+	assert.Equal(t, ID{CallID: id.CallID, LocalTag: id.RemoteTag, RemoteTag: id.LocalTag}, d.ID())
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{
+		`"Proxy, Inc." <sip:p1.example.com;lr>`,
+		"<sip:p2.example.com;lr;foo=a,b>",
+		"<sip:p3.example.com>",
+	}, splitList(`"Proxy, Inc." <sip:p1.example.com;lr>, <sip:p2.example.com;lr;foo=a,b> ,<sip:p3.example.com>`))
+	assert.Nil(t, splitList(""))
+}
+
+func TestStore(t *testing.T) {
+	d, err := NewUAC(testInvite(t), testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Nil(t, err)
+
+	s := NewStore()
+	assert.Nil(t, s.Add(d))
+	assert.Equal(t, ErrExists, s.Add(d))
+	assert.Equal(t, 1, s.Len())
+
+	id, err := ResponseID(testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Nil(t, err)
+	got, ok := s.Get(id)
+	assert.True(t, ok)
+	assert.Equal(t, d, got)
+
+	s.Remove(id)
+	_, ok = s.Get(id)
+	assert.False(t, ok)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	req := testInvite(t)
+	s := NewStore()
+	var wg sync.WaitGroup
+	for _, tag := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			d, err := NewUAC(req, testResponse(t, sip.StatusOK, tag))
+			assert.Nil(t, err)
+			assert.Nil(t, s.Add(d))
+			_, ok := s.Get(d.ID())
+			assert.True(t, ok)
+		}(tag)
+	}
+	wg.Wait()
+	assert.Equal(t, 4, s.Len())
+}
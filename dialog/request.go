@@ -0,0 +1,173 @@
+package dialog
+
+import (
+	"errors"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transaction"
+)
+
+var (
+	ErrMethod     = errors.New("dialog: method cannot be sent as a new request within a dialog")
+	ErrTerminated = errors.New("dialog: dialog terminated")
+	ErrNoDialog   = errors.New("dialog: request does not match a dialog")
+	ErrOutOfOrder = errors.New("dialog: request is out of order")
+)
+
+// NewRequest builds a request within the dialog, such as a BYE, re-INVITE,
+// INFO, UPDATE, REFER or NOTIFY. The local sequence number is incremented
+// for each request. Target refresh requests carry the local Contact. A Via
+// is left to the transaction layer.
+//
+// ACK and CANCEL are not new requests; see NewAck and the transaction
+// manager.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-12.2.1.1
+func (d *Dialog) NewRequest(method string) (sip.Message, error) {
+	if method == sip.MethodAck || method == sip.MethodCancel {
+		return nil, ErrMethod
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state == StateTerminated {
+		return nil, ErrTerminated
+	}
+	uri, routes, err := d.target()
+	if err != nil {
+		return nil, err
+	}
+	d.localSeq++
+	return d.build(method, d.localSeq, uri, routes), nil
+}
+
+// NewAck builds the ACK for a 2xx response to invite, an INVITE sent within
+// or creating the dialog. It has the sequence number of the INVITE and is
+// sent end-to-end rather than by the transaction, straight over the
+// transport. Since it is a transaction of its own it has a Via with a new
+// branch.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-13.2.2.4
+func (d *Dialog) NewAck(invite sip.Message) (sip.Message, error) {
+	if invite.Method() != sip.MethodInvite {
+		return nil, ErrMethod
+	}
+	cseq, ok := invite.CSeq()
+	if !ok {
+		return nil, ErrMissingHeader
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	uri, routes, err := d.target()
+	if err != nil {
+		return nil, err
+	}
+	ack := d.build(sip.MethodAck, cseq.Sequence, uri, routes)
+	ack.AppendHeader(&sip.Via{Transport: "udp", Branch: transaction.NewBranch()})
+	return ack, nil
+}
+
+// target returns the Request-URI and Route header field values of requests
+// within the dialog. If the first route is a loose router the request is
+// sent to the remote target through the whole route set. Otherwise the first
+// route becomes the Request-URI and the remote target is appended to the
+// remaining routes.
+func (d *Dialog) target() (sip.URI, []string, error) {
+	if len(d.routeSet) == 0 {
+		return d.remoteTarget, nil, nil
+	}
+	first, err := sip.ParseURI(d.routeSet[0])
+	if err != nil {
+		return sip.URI{}, nil, err
+	}
+	if first.LR {
+		return d.remoteTarget, append([]string(nil), d.routeSet...), nil
+	}
+	routes := append([]string(nil), d.routeSet[1:]...)
+	routes = append(routes, "<"+d.remoteTarget.String()+">")
+	return first, routes, nil
+}
+
+func (d *Dialog) build(method string, seq uint32, uri sip.URI, routes []string) sip.Message {
+	req := sip.NewRequest(method, uri)
+
+	for _, route := range routes {
+		req.AppendHeader(sip.Route(route))
+	}
+	req.AppendHeader(sip.MaxForwards(70))
+	from := d.local
+	req.AppendHeader(&from)
+	to := d.remote
+	req.AppendHeader(&to)
+	req.AppendHeader(sip.CallID(d.id.CallID))
+	req.AppendHeader(&sip.CSeq{Sequence: seq, Method: method})
+	if d.localTarget != nil && isTargetRefresh(method) {
+		contact := *d.localTarget
+		req.AppendHeader(&contact)
+	}
+
+	return req
+}
+
+// Receive validates req, a request received within the dialog, and updates
+// the remote sequence number. A target refresh request replaces the remote
+// target with its Contact. The dialog is only updated once the request has
+// passed all checks: an out of order request, or a target refresh request
+// without a usable Contact, changes neither. ACK and CANCEL reuse the
+// sequence number of the request they refer to and are not checked.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-12.2.2
+func (d *Dialog) Receive(req sip.Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state == StateTerminated {
+		return ErrTerminated
+	}
+	method := req.Method()
+	if method == sip.MethodAck || method == sip.MethodCancel {
+		return nil
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return ErrMissingHeader
+	}
+	if d.remoteSeqSet && cseq.Sequence < d.remoteSeq {
+		return ErrOutOfOrder
+	}
+	refresh := isTargetRefresh(method)
+	var target sip.URI
+	if refresh {
+		var err error
+		if target, err = contactURI(req); err != nil {
+			return err
+		}
+	}
+
+	d.remoteSeq = cseq.Sequence
+	d.remoteSeqSet = true
+	if refresh {
+		d.remoteTarget = target
+	}
+	return nil
+}
+
+// Reject builds the response to a request that Receive or Store.Receive
+// returned err for: 481 if it does not match a dialog, 500 if it is out of
+// order and 400 if it lacks header fields or a Contact. It returns nil for
+// an ACK, which is never answered.
+func Reject(req sip.Message, err error) sip.Message {
+	if req.Method() == sip.MethodAck {
+		return nil
+	}
+	switch {
+	case errors.Is(err, ErrNoDialog), errors.Is(err, ErrTerminated):
+		return sip.NewResponse(req, sip.StatusCallTransactionDoesNotExist, "")
+	case errors.Is(err, ErrOutOfOrder):
+		return sip.NewResponse(req, sip.StatusInternalServerError, "")
+	}
+	return sip.NewResponse(req, sip.StatusBadRequest, "")
+}
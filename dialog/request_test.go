@@ -0,0 +1,204 @@
+package dialog
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transaction"
+	"github.com/nilssonr/sip/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRequestLooseRouting(t *testing.T) {
+	d, err := NewUAC(testInvite(t), testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Nil(t, err)
+
+	bye, err := d.NewRequest(sip.MethodBye)
+	assert.Nil(t, err)
+	assert.Equal(t, sip.MethodBye, bye.Method())
+	assert.Equal(t, "sips:bob@client.biloxi.com:5061", bye.RequestURI().String())
+
+	var routes []string
+	for _, route := range bye.GetHeaders("route") {
+		routes = append(routes, string(route.(sip.Route)))
+	}
+	assert.Equal(t, []string{"<sip:p1.atlanta.com;lr>", "<sip:p2.biloxi.com;lr>"}, routes)
+
+	from, _ := bye.From()
+	assert.Equal(t, "1928301774", from.Tag)
+	assert.Equal(t, "alice", from.User)
+	to, _ := bye.To()
+	assert.Equal(t, "a6c85cf", to.Tag)
+	assert.Equal(t, "bob", to.User)
+	callID, _ := bye.CallID()
+	assert.Equal(t, "a84b4c76e66710@pc33.atlanta.com", string(*callID))
+	cseq, _ := bye.CSeq()
+	assert.Equal(t, sip.CSeq{Sequence: 314160, Method: sip.MethodBye}, *cseq)
+	_, ok := bye.Contact()
+	assert.False(t, ok)
+
+	// Target refresh requests carry the local Contact.
+	reinvite, err := d.NewRequest(sip.MethodInvite)
+	assert.Nil(t, err)
+	cseq, _ = reinvite.CSeq()
+	assert.Equal(t, uint32(314161), cseq.Sequence)
+	contact, ok := reinvite.Contact()
+	assert.True(t, ok)
+	assert.Equal(t, "pc33.atlanta.com", contact.Host)
+	assert.Equal(t, uint32(314161), d.LocalSeq())
+
+	// The ACK of the re-INVITE has its sequence number.
+	ack, err := d.NewAck(reinvite)
+	assert.Nil(t, err)
+	cseq, _ = ack.CSeq()
+	assert.Equal(t, sip.CSeq{Sequence: 314161, Method: sip.MethodAck}, *cseq)
+	assert.Equal(t, uint32(314161), d.LocalSeq())
+}
+
+func TestNewAckSentOverTransport(t *testing.T) {
+	server := transport.NewLayer()
+	addr, err := server.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+	client := transport.NewLayer()
+	_, err = client.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Shutdown(context.Background())
+
+	res := testResponse(t, sip.StatusOK, "a6c85cf")
+	res.RemoveHeader("record-route")
+	res.RemoveHeader("contact")
+	res.AppendHeader(&sip.Contact{Scheme: "sip", User: "bob", Host: "127.0.0.1", Port: strconv.Itoa(addr.(*net.UDPAddr).Port)})
+	invite := testInvite(t)
+	d, err := NewUAC(invite, res)
+	assert.Nil(t, err)
+
+	// The ACK for a 2xx is a transaction of its own, with a new branch.
+	ack, err := d.NewAck(invite)
+	assert.Nil(t, err)
+	assert.Nil(t, client.Send(ack))
+
+	msg := <-server.Messages()
+	assert.Equal(t, sip.MethodAck, msg.Method())
+	vias, _ := msg.Via()
+	inviteVias, _ := invite.Via()
+	assert.True(t, strings.HasPrefix(vias[0].Branch, transaction.MagicCookie))
+	assert.NotEqual(t, inviteVias[0].Branch, vias[0].Branch)
+}
+
+func TestNewRequestStrictRouting(t *testing.T) {
+	res := testResponse(t, sip.StatusOK, "a6c85cf")
+	res.RemoveHeader("record-route")
+	res.AppendHeader(sip.RecordRoute("<sip:p2.biloxi.com>, <sip:p1.atlanta.com;transport=tcp>"))
+	d, err := NewUAC(testInvite(t), res)
+	assert.Nil(t, err)
+
+	info, err := d.NewRequest(sip.MethodInfo)
+	assert.Nil(t, err)
+	assert.Equal(t, "sip:p1.atlanta.com;transport=tcp", info.RequestURI().String())
+
+	var routes []string
+	for _, route := range info.GetHeaders("route") {
+		routes = append(routes, string(route.(sip.Route)))
+	}
+	assert.Equal(t, []string{"<sip:p2.biloxi.com>", "<sips:bob@client.biloxi.com:5061>"}, routes)
+}
+
+func TestNewRequestErrors(t *testing.T) {
+	d, err := NewUAC(testInvite(t), testResponse(t, sip.StatusOK, "a6c85cf"))
+	assert.Nil(t, err)
+
+	_, err = d.NewRequest(sip.MethodCancel)
+	assert.Equal(t, ErrMethod, err)
+	_, err = d.NewRequest(sip.MethodAck)
+	assert.Equal(t, ErrMethod, err)
+
+	d.Terminate()
+	_, err = d.NewRequest(sip.MethodBye)
+	assert.Equal(t, ErrTerminated, err)
+	assert.Equal(t, uint32(314159), d.LocalSeq())
+}
+
+func TestStoreReceive(t *testing.T) {
+	invite := testInvite(t)
+	res := testResponse(t, sip.StatusOK, "a6c85cf")
+	uac, err := NewUAC(invite, res)
+	assert.Nil(t, err)
+	uas, err := NewUAS(invite, res)
+	assert.Nil(t, err)
+
+	s := NewStore()
+	assert.Nil(t, s.Add(uas))
+
+	update, err := uac.NewRequest(sip.MethodUpdate)
+	assert.Nil(t, err)
+	contact, _ := update.Contact()
+	contact.Host = "pc34.atlanta.com"
+	bye, err := uac.NewRequest(sip.MethodBye)
+	assert.Nil(t, err)
+
+	d, err := s.Receive(bye)
+	assert.Nil(t, err)
+	assert.Equal(t, uas, d)
+	seq, _ := uas.RemoteSeq()
+	assert.Equal(t, uint32(314161), seq)
+
+	// The UPDATE arrives after the BYE.
+	_, err = s.Receive(update)
+	assert.Equal(t, ErrOutOfOrder, err)
+	assert.Equal(t, sip.StatusInternalServerError, Reject(update, err).StatusCode())
+	assert.Equal(t, "pc33.atlanta.com", uas.RemoteTarget().Host)
+
+	// An ACK has the sequence number of its INVITE.
+	ack, err := uac.NewAck(invite)
+	assert.Nil(t, err)
+	_, err = s.Receive(ack)
+	assert.Nil(t, err)
+
+	s.Remove(uas.ID())
+	_, err = s.Receive(bye)
+	assert.Equal(t, ErrNoDialog, err)
+	assert.Equal(t, sip.StatusCallTransactionDoesNotExist, Reject(bye, err).StatusCode())
+	assert.Nil(t, Reject(ack, ErrNoDialog))
+}
+
+func TestReceiveTargetRefresh(t *testing.T) {
+	invite := testInvite(t)
+	res := testResponse(t, sip.StatusOK, "a6c85cf")
+	uac, err := NewUAC(invite, res)
+	assert.Nil(t, err)
+	uas, err := NewUAS(invite, res)
+	assert.Nil(t, err)
+
+	reinvite, err := uac.NewRequest(sip.MethodInvite)
+	assert.Nil(t, err)
+	contact, _ := reinvite.Contact()
+	contact.Host = "pc34.atlanta.com"
+
+	assert.Nil(t, uas.Receive(reinvite))
+	assert.Equal(t, "pc34.atlanta.com", uas.RemoteTarget().Host)
+}
+
+func TestReceiveRejectedTargetRefresh(t *testing.T) {
+	invite := testInvite(t)
+	res := testResponse(t, sip.StatusOK, "a6c85cf")
+	uac, err := NewUAC(invite, res)
+	assert.Nil(t, err)
+	uas, err := NewUAS(invite, res)
+	assert.Nil(t, err)
+
+	// A re-INVITE without a Contact is rejected and changes nothing.
+	reinvite, err := uac.NewRequest(sip.MethodInvite)
+	assert.Nil(t, err)
+	reinvite.RemoveHeader("contact")
+	err = uas.Receive(reinvite)
+	assert.Equal(t, ErrNoContact, err)
+	assert.Equal(t, sip.StatusBadRequest, Reject(reinvite, err).StatusCode())
+	seq, _ := uas.RemoteSeq()
+	assert.Equal(t, uint32(314159), seq)
+	assert.Equal(t, "pc33.atlanta.com", uas.RemoteTarget().Host)
+}
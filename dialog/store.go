@@ -0,0 +1,78 @@
+package dialog
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+var ErrExists = errors.New("dialog: dialog already exists")
+
+// Store holds the dialogs of a user agent by ID. It is safe for concurrent
+// use.
+type Store struct {
+	mu      sync.RWMutex
+	dialogs map[ID]*Dialog
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{dialogs: make(map[ID]*Dialog)}
+}
+
+// Add adds d to the store. It returns ErrExists if a dialog with the same ID
+// has already been added.
+func (s *Store) Add(d *Dialog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.dialogs[d.ID()]; exists {
+		return ErrExists
+	}
+	s.dialogs[d.ID()] = d
+	return nil
+}
+
+// Get returns the dialog with the given ID.
+func (s *Store) Get(id ID) (*Dialog, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.dialogs[id]
+	return d, ok
+}
+
+// Remove removes the dialog with the given ID from the store.
+func (s *Store) Remove(id ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.dialogs, id)
+}
+
+// Len returns the number of dialogs in the store.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.dialogs)
+}
+
+// Receive looks up the dialog of req, a request received with a To tag, and
+// validates it with Dialog.Receive. It returns ErrNoDialog if no dialog
+// matches.
+func (s *Store) Receive(req sip.Message) (*Dialog, error) {
+	id, err := RequestID(req)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := s.Get(id)
+	if !ok {
+		return nil, ErrNoDialog
+	}
+	if err := d.Receive(req); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/nilssonr/sip/transport"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	transl := transport.NewLayer()
 	go func() {
 		for msg := range transl.Messages() {
-			fmt.Println("Got message")
+			fmt.Printf("Got message from %s over %s\n", msg.Source, msg.Transport)
 			fmt.Printf("Method: %s\n", msg.Method())
 
 			if callID, ok := msg.CallID(); ok {
@@ -28,7 +36,22 @@ func main() {
 			}
 		}
 	}()
-	transl.Listen("tcp", "0.0.0.0:5060")
+	go func() {
+		for err := range transl.Errors() {
+			fmt.Println(err)
+		}
+	}()
+
+	if _, err := transl.Listen(ctx, "tcp", "0.0.0.0:5060"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	<-ctx.Done()
 
-	select {}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := transl.Shutdown(shutdownCtx); err != nil {
+		fmt.Println(err)
+	}
 }
@@ -1,5 +1,10 @@
 package sip
 
+import (
+	"strconv"
+	"strings"
+)
+
 type Header interface {
 	Name() string
 }
@@ -13,6 +18,7 @@ type RequestLine struct {
 	Host              string
 	Port              string
 	UserType          string
+	Transport         string
 }
 
 // Accept follows the syntax defined in [H14.1].  The semantics are also
@@ -78,6 +84,8 @@ type Allow []string
 
 func (Allow) Name() string { return "Allow" }
 
+func (h Allow) String() string { return strings.Join(h, ",") }
+
 // AuthenticationInfo rovides for mutual authentication with HTTP Digest.
 // A UAS MAY include this header field in a 2xx response to a request that
 // was successfully authenticated using digest based on the Authorization header
@@ -148,12 +156,44 @@ type Contact struct {
 	Host        string
 	Port        string
 	Transport   string
-	Q           string
-	Expires     int
+	UserType    string
+	Maddr       string
+	// LR is set when the URI has the "lr" parameter.
+	LR bool
+	// Ob is set when the URI has the "ob" parameter, with which a SIP
+	// Outbound client asks for requests to reach it over the flow it
+	// registered on.
+	//
+	// See: https://datatracker.ietf.org/doc/html/rfc5626#section-4.2.1
+	Ob      bool
+	Q       string
+	Expires int
 }
 
 func (Contact) Name() string { return "Contact" }
 
+func (h Contact) String() string {
+	var sb strings.Builder
+	writeNameAddr(&sb, h.DisplayName, URI{
+		Scheme:    h.Scheme,
+		User:      h.User,
+		Host:      h.Host,
+		Port:      h.Port,
+		Transport: h.Transport,
+		UserType:  h.UserType,
+		Maddr:     h.Maddr,
+		LR:        h.LR,
+		Ob:        h.Ob,
+	})
+	if h.Q != "" {
+		sb.WriteString(";q=" + h.Q)
+	}
+	if h.Expires > 0 {
+		sb.WriteString(";expires=" + strconv.Itoa(h.Expires))
+	}
+	return sb.String()
+}
+
 // ContentDisposition describes how the message body or, for multipart
 // messages, a message body part is to be interpreted by the UAC or UAS.
 // This SIP header field extends the MIME Content-Type (RFC 2183 [18]).
@@ -172,6 +212,10 @@ func (CSeq) Name() string {
 	return "CSeq"
 }
 
+func (h CSeq) String() string {
+	return strconv.FormatUint(uint64(h.Sequence), 10) + " " + h.Method
+}
+
 type From struct {
 	Scheme      string
 	DisplayName string
@@ -184,6 +228,10 @@ type From struct {
 
 func (From) Name() string { return "From" }
 
+func (h From) String() string {
+	return formatNameAddr(h.DisplayName, h.Scheme, h.User, h.Host, h.Port, h.UserType, h.Tag)
+}
+
 type MaxForwards uint8
 
 func (MaxForwards) Name() string { return "Max-Forwards" }
@@ -305,6 +353,10 @@ type To struct {
 
 func (To) Name() string { return "To" }
 
+func (h To) String() string {
+	return formatNameAddr(h.DisplayName, h.Scheme, h.User, h.Host, h.Port, h.UserType, h.Tag)
+}
+
 type Unsupported string
 
 func (Unsupported) Name() string { return "Unsupported" }
@@ -313,19 +365,61 @@ type UserAgent string
 
 func (UserAgent) Name() string { return "User-Agent" }
 
+// Via indicates the path taken by the request so far and indicates the path
+// that should be followed in routing responses.
+//
+// RportRequested is set when the "rport" parameter is present without a value,
+// meaning the client asks the server to fill in the source port of the request.
+// Alias is set when the client asks the server to reuse the connection for
+// requests in the opposite direction.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-20.42
+// See: https://datatracker.ietf.org/doc/html/rfc3581
+// See: https://datatracker.ietf.org/doc/html/rfc5923
 type Via struct {
-	Transport string
-	Host      string
-	Port      string
-	Branch    string
-	Rport     string
-	Maddr     string
-	TTL       string
-	Received  string
+	Transport      string
+	Host           string
+	Port           string
+	Branch         string
+	Rport          string
+	RportRequested bool
+	Alias          bool
+	Maddr          string
+	TTL            string
+	Received       string
 }
 
 func (Via) Name() string { return "Via" }
 
+func (h Via) String() string {
+	var sb strings.Builder
+	sb.WriteString("SIP/2.0/" + strings.ToUpper(h.Transport) + " " + h.Host)
+	if h.Port != "" {
+		sb.WriteString(":" + h.Port)
+	}
+	if h.Branch != "" {
+		sb.WriteString(";branch=" + h.Branch)
+	}
+	if h.Rport != "" {
+		sb.WriteString(";rport=" + h.Rport)
+	} else if h.RportRequested {
+		sb.WriteString(";rport")
+	}
+	if h.Alias {
+		sb.WriteString(";alias")
+	}
+	if h.Maddr != "" {
+		sb.WriteString(";maddr=" + h.Maddr)
+	}
+	if h.TTL != "" {
+		sb.WriteString(";ttl=" + h.TTL)
+	}
+	if h.Received != "" {
+		sb.WriteString(";received=" + h.Received)
+	}
+	return sb.String()
+}
+
 type Warning string
 
 func (Warning) Name() string { return "Warning" }
@@ -333,3 +427,26 @@ func (Warning) Name() string { return "Warning" }
 type WWWAuthenticate string
 
 func (WWWAuthenticate) Name() string { return "WWW-Authenticate" }
+
+// formatNameAddr renders the name-addr form shared by From and To.
+func formatNameAddr(displayName, scheme, user, host, port, userType, tag string) string {
+	var sb strings.Builder
+	writeNameAddr(&sb, displayName, URI{
+		Scheme:   scheme,
+		User:     user,
+		Host:     host,
+		Port:     port,
+		UserType: userType,
+	})
+	if tag != "" {
+		sb.WriteString(";tag=" + tag)
+	}
+	return sb.String()
+}
+
+func writeNameAddr(sb *strings.Builder, displayName string, uri URI) {
+	if displayName != "" {
+		sb.WriteString(`"` + displayName + `" `)
+	}
+	sb.WriteString("<" + uri.String() + ">")
+}
@@ -1,6 +1,8 @@
 package sip
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -54,19 +56,35 @@ type Message interface {
 	WWWAuthenticate() (*WWWAuthenticate, bool)
 
 	Method() string
+	RequestURI() URI
+	StatusCode() int
+	Reason() string
 
 	AppendHeader(header Header)
+	SetHeader(header Header)
+	RemoveHeader(name string)
 	GetHeaders(name string) []Header
+
+	Body() []byte
+	SetBody(body []byte)
+
+	// String renders the message in its wire format.
+	String() string
 }
 
 func IsRequest(msg Message) bool {
-	return msg.Method() == ""
+	return msg.Method() != ""
+}
+
+func IsResponse(msg Message) bool {
+	return !IsRequest(msg)
 }
 
 type defaultMessage struct {
-	method string
-	host   string
-	port   string
+	method     string
+	uri        URI
+	statusCode int
+	reason     string
 	*headers
 }
 
@@ -294,11 +312,15 @@ func (msg defaultMessage) Warning() (*Warning, bool) {
 	return getHeader[Warning]("warning", msg)
 }
 
-func newMessage(rl *RequestLine) Message {
+// newMessage creates a message with the start line rl and the Request-URI
+// uri, which is kept whole since RequestLine lacks parameters such as maddr,
+// lr and ob.
+func newMessage(rl *RequestLine, uri URI) Message {
 	return defaultMessage{
-		method: rl.Method,
-		host:   rl.Host,
-		port:   rl.Port,
+		method:     rl.Method,
+		uri:        uri,
+		statusCode: rl.StatusCode,
+		reason:     rl.StatusDescription,
 		headers: &headers{
 			headers: map[string][]Header{},
 			mu:      sync.RWMutex{},
@@ -306,10 +328,84 @@ func newMessage(rl *RequestLine) Message {
 	}
 }
 
+// NewRequest creates a request without any header fields.
+func NewRequest(method string, uri URI) Message {
+	return newMessage(&RequestLine{Method: method}, uri)
+}
+
+// NewResponse creates a response to req as described in RFC 3261 section
+// 8.2.6.2. The Via, From, To, Call-ID and CSeq header fields are copied from
+// the request. If reason is empty the default reason phrase for the status
+// code is used.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-8.2.6.2
+func NewResponse(req Message, code int, reason string) Message {
+	if reason == "" {
+		reason = StatusText(code)
+	}
+
+	res := newMessage(&RequestLine{
+		StatusCode:        code,
+		StatusDescription: reason,
+	}, URI{})
+
+	for _, name := range []string{"via", "from", "to", "call-id", "cseq"} {
+		for _, header := range req.GetHeaders(name) {
+			res.AppendHeader(cloneHeader(header))
+		}
+	}
+
+	if code == StatusTrying {
+		for _, header := range req.GetHeaders("timestamp") {
+			res.AppendHeader(header)
+		}
+	}
+
+	return res
+}
+
 func (msg defaultMessage) Method() string {
 	return msg.method
 }
 
+func (msg defaultMessage) RequestURI() URI {
+	return msg.uri
+}
+
+func (msg defaultMessage) StatusCode() int {
+	return msg.statusCode
+}
+
+func (msg defaultMessage) Reason() string {
+	return msg.reason
+}
+
+func (msg defaultMessage) String() string {
+	var sb strings.Builder
+
+	if msg.method != "" {
+		sb.WriteString(msg.method + " " + msg.uri.String() + " SIP/2.0\r\n")
+	} else {
+		sb.WriteString("SIP/2.0 " + strconv.Itoa(msg.statusCode) + " " + msg.reason + "\r\n")
+	}
+
+	msg.headers.mu.RLock()
+	defer msg.headers.mu.RUnlock()
+
+	for _, name := range msg.headers.order {
+		if name == "content-length" {
+			continue
+		}
+		for _, header := range msg.headers.headers[name] {
+			sb.WriteString(header.Name() + ": " + fmt.Sprint(header) + "\r\n")
+		}
+	}
+	sb.WriteString("Content-Length: " + strconv.Itoa(len(msg.headers.body)) + "\r\n\r\n")
+	sb.Write(msg.headers.body)
+
+	return sb.String()
+}
+
 func getHeader[T any](name string, msg Message) (*T, bool) {
 	headers := msg.GetHeaders(name)
 
@@ -317,16 +413,43 @@ func getHeader[T any](name string, msg Message) (*T, bool) {
 		return nil, false
 	}
 
-	allow, ok := headers[0].(T)
-	if !ok {
-		return nil, false
+	switch header := any(headers[0]).(type) {
+	case T:
+		return &header, true
+	case *T:
+		return header, true
 	}
 
-	return &allow, true
+	return nil, false
+}
+
+// cloneHeader copies header fields that are stored by reference so that a
+// message derived from another can be modified independently.
+func cloneHeader(header Header) Header {
+	switch h := header.(type) {
+	case *Via:
+		c := *h
+		return &c
+	case *From:
+		c := *h
+		return &c
+	case *To:
+		c := *h
+		return &c
+	case *CSeq:
+		c := *h
+		return &c
+	case *Contact:
+		c := *h
+		return &c
+	}
+	return header
 }
 
 type headers struct {
 	headers map[string][]Header
+	order   []string
+	body    []byte
 	mu      sync.RWMutex
 }
 
@@ -337,11 +460,56 @@ func (h *headers) AppendHeader(header Header) {
 	name := strings.ToLower(header.Name())
 	if _, ok := h.headers[name]; !ok {
 		h.headers[name] = []Header{header}
+		h.order = append(h.order, name)
 	} else {
 		h.headers[name] = append(h.headers[name], header)
 	}
 }
 
+// SetHeader replaces all header fields with the same name as header.
+func (h *headers) SetHeader(header Header) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name := strings.ToLower(header.Name())
+	if _, ok := h.headers[name]; !ok {
+		h.order = append(h.order, name)
+	}
+	h.headers[name] = []Header{header}
+}
+
+// RemoveHeader removes all header fields with the given name.
+func (h *headers) RemoveHeader(name string) {
+	name = strings.ToLower(name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.headers[name]; !ok {
+		return
+	}
+	delete(h.headers, name)
+	for i, n := range h.order {
+		if n == name {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (h *headers) Body() []byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.body
+}
+
+func (h *headers) SetBody(body []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.body = body
+}
+
 func (h *headers) GetHeaders(name string) []Header {
 	name = strings.ToLower(name)
 	h.mu.Lock()
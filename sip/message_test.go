@@ -1,5 +1,11 @@
 package sip
 
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
 // func TestParseMessage(t *testing.T) {
 // 	tests := []struct {
 // 		Input    []byte
@@ -25,3 +31,34 @@ package sip
 // 		assert.Nil(t, err)
 // 	}
 // }
+
+func TestNewResponse(t *testing.T) {
+	req, err := Parse([]byte("INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bKnashds8;rport\r\n" +
+		"To: Bob <sip:bob@biloxi.com>\r\n" +
+		"From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.True(t, IsRequest(req))
+
+	res := NewResponse(req, StatusRinging, "")
+	assert.True(t, IsResponse(res))
+	assert.Equal(t, "Ringing", res.Reason())
+
+	to, ok := res.To()
+	assert.True(t, ok)
+	to.Tag = "a6c85cf"
+
+	reqTo, _ := req.To()
+	assert.Equal(t, "", reqTo.Tag)
+
+	assert.Equal(t, "SIP/2.0 180 Ringing\r\n"+
+		"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bKnashds8;rport\r\n"+
+		"From: \"Alice\" <sip:alice@atlanta.com>;tag=1928301774\r\n"+
+		"To: \"Bob\" <sip:bob@biloxi.com>;tag=a6c85cf\r\n"+
+		"Call-ID: a84b4c76e66710\r\n"+
+		"CSeq: 314159 INVITE\r\n"+
+		"Content-Length: 0\r\n\r\n", res.String())
+}
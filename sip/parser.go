@@ -2,10 +2,14 @@ package sip
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 )
 
+var ErrInvalidStartLine = errors.New("sip: invalid start line")
+
 var (
 	crlf           = []byte("\r\n")
 	defaultParsers = map[string]func(b []byte) ([]Header, error){
@@ -40,15 +44,29 @@ var (
 	}
 )
 
+// Parse parses a single message. If a header field cannot be parsed the
+// remaining header fields are still parsed and the message is returned together
+// with the first error, so that the caller can answer it with 400 Bad Request.
+// A nil message is returned only when the start line is invalid.
 func Parse(b []byte) (Message, error) {
+	var body []byte
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		b, body = b[:i], b[i+4:]
+	}
+
 	lines := bytes.Split(b, crlf)
 
 	r, err := parseRequestLine(lines[0])
 	if err != nil {
 		return nil, err
 	}
+	if r.Method == "" && r.StatusCode == 0 {
+		return nil, ErrInvalidStartLine
+	}
+
+	msg := newMessage(r, requestURI(lines[0], r))
 
-	msg := newMessage(r)
+	var parseErr error
 
 	for i := 1; i < len(lines); i++ {
 		line := lines[i]
@@ -61,7 +79,10 @@ func Parse(b []byte) (Message, error) {
 			if parser, exists := defaultParsers[hdr]; exists {
 				hdrs, err := parser(val)
 				if err != nil {
-					return nil, err
+					if parseErr == nil {
+						parseErr = fmt.Errorf("sip: invalid %s header: %w", hdr, err)
+					}
+					continue
 				}
 				for _, v := range hdrs {
 					msg.AppendHeader(v)
@@ -70,7 +91,15 @@ func Parse(b []byte) (Message, error) {
 		}
 
 	}
-	return msg, nil
+
+	if cl, ok := msg.ContentLength(); ok && *cl >= 0 && int(*cl) < len(body) {
+		body = body[:*cl]
+	}
+	if len(body) > 0 {
+		msg.SetBody(body)
+	}
+
+	return msg, parseErr
 }
 
 type Field int
@@ -107,6 +136,28 @@ const (
 	FieldIgnore     Field = 255
 )
 
+// requestURI returns the Request-URI of the start line b, which rl was
+// parsed from, with all its parameters. It falls back to the fields of rl if
+// the URI cannot be parsed.
+func requestURI(b []byte, rl *RequestLine) URI {
+	uri := URI{
+		Scheme:    rl.Scheme,
+		User:      rl.User,
+		Host:      rl.Host,
+		Port:      rl.Port,
+		UserType:  rl.UserType,
+		Transport: rl.Transport,
+	}
+	fields := bytes.Fields(b)
+	if rl.Method == "" || len(fields) != 3 {
+		return uri
+	}
+	if parsed, err := ParseURI(string(fields[1])); err == nil {
+		return parsed
+	}
+	return uri
+}
+
 func parseRequestLine(b []byte) (*RequestLine, error) {
 	var (
 		pos               = 0
@@ -119,6 +170,7 @@ func parseRequestLine(b []byte) (*RequestLine, error) {
 		host              = []byte{}
 		port              = []byte{}
 		userType          = []byte{}
+		transport         = []byte{}
 	)
 
 	// Loop through the bytes making up the line
@@ -170,6 +222,11 @@ func parseRequestLine(b []byte) (*RequestLine, error) {
 					pos = pos + 5
 					continue
 				}
+				if getString(b, pos, pos+10) == "transport=" {
+					state = FieldTransport
+					pos = pos + 10
+					continue
+				}
 				if b[pos] == '@' {
 					state = FieldHost
 					user = host // Move host to user
@@ -227,6 +284,14 @@ func parseRequestLine(b []byte) (*RequestLine, error) {
 			}
 			userType = append(userType, b[pos])
 
+		case FieldTransport:
+			if b[pos] == ';' || b[pos] == '>' || b[pos] == ' ' {
+				state = FieldBase
+				pos++
+				continue
+			}
+			transport = append(transport, b[pos])
+
 		case FieldStatus:
 			if b[pos] == ';' || b[pos] == '>' {
 				state = FieldBase
@@ -269,6 +334,7 @@ func parseRequestLine(b []byte) (*RequestLine, error) {
 	result.Host = string(host)
 	result.Port = string(port)
 	result.UserType = string(userType)
+	result.Transport = strings.ToLower(string(transport))
 	return &result, nil
 }
 
@@ -628,6 +694,10 @@ func parseContact(b []byte) ([]Header, error) {
 		transport   = []byte{}
 		q           = []byte{}
 		expires     = []byte{}
+		userType    = []byte{}
+		maddr       = []byte{}
+		lr          bool
+		ob          bool
 	)
 
 	for pos < len(b) {
@@ -681,6 +751,29 @@ func parseContact(b []byte) ([]Header, error) {
 					pos = pos + 4
 					continue
 				}
+				// Look for a user type identifier
+				if getString(b, pos, pos+5) == "user=" {
+					state = FieldUserType
+					pos = pos + 5
+					continue
+				}
+				// Look for a maddr identifier
+				if getString(b, pos, pos+6) == "maddr=" {
+					state = FieldMaddr
+					pos = pos + 6
+					continue
+				}
+				// Look for the loose routing and outbound flags
+				if isFlag(b, pos, "lr") {
+					lr = true
+					pos = pos + 2
+					continue
+				}
+				if isFlag(b, pos, "ob") {
+					ob = true
+					pos = pos + 2
+					continue
+				}
 				// Look for other identifiers and ignore
 				if b[pos] == '=' {
 					state = FieldIgnore
@@ -763,6 +856,22 @@ func parseContact(b []byte) ([]Header, error) {
 			}
 			expires = append(expires, b[pos])
 
+		case FieldUserType:
+			if b[pos] == ';' || b[pos] == '>' || b[pos] == ' ' {
+				state = FieldBase
+				pos++
+				continue
+			}
+			userType = append(userType, b[pos])
+
+		case FieldMaddr:
+			if b[pos] == ';' || b[pos] == '>' || b[pos] == ' ' {
+				state = FieldBase
+				pos++
+				continue
+			}
+			maddr = append(maddr, b[pos])
+
 		case FieldIgnore:
 			if b[pos] == ';' || b[pos] == '>' {
 				state = FieldBase
@@ -780,6 +889,10 @@ func parseContact(b []byte) ([]Header, error) {
 	result.Host = string(host)
 	result.Port = string(port)
 	result.Transport = string(transport)
+	result.UserType = string(userType)
+	result.Maddr = string(maddr)
+	result.LR = lr
+	result.Ob = ob
 	result.Q = string(q)
 
 	if len(expires) > 0 {
@@ -793,7 +906,44 @@ func parseContact(b []byte) ([]Header, error) {
 	return []Header{&result}, nil
 }
 
+// isFlag reports whether b holds the parameter name without a value at pos.
+func isFlag(b []byte, pos int, name string) bool {
+	end := pos + len(name)
+	if pos == 0 || b[pos-1] != ';' || getString(b, pos, end) != name {
+		return false
+	}
+	return end == len(b) || strings.IndexByte("; >", b[end]) >= 0
+}
+
+// parseVia parses a Via header field value, which may hold several
+// comma-separated Vias. Each becomes a header of its own so that the Vias are
+// listed in order.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-7.3.1
 func parseVia(b []byte) ([]Header, error) {
+	var (
+		headers []Header
+		start   int
+		quoted  bool
+	)
+	for i := 0; i <= len(b); i++ {
+		if i < len(b) {
+			if b[i] == '"' {
+				quoted = !quoted
+			}
+			if b[i] != ',' || quoted {
+				continue
+			}
+		}
+		if value := bytes.TrimSpace(b[start:i]); len(value) > 0 {
+			headers = append(headers, parseViaValue(value))
+		}
+		start = i + 1
+	}
+	return headers, nil
+}
+
+func parseViaValue(b []byte) *Via {
 	var (
 		pos       = 0
 		state     = FieldBase
@@ -805,6 +955,9 @@ func parseVia(b []byte) ([]Header, error) {
 		maddr     = []byte{}
 		ttl       = []byte{}
 		received  = []byte{}
+
+		rportRequested bool
+		alias          bool
 	)
 
 	for pos < len(b) {
@@ -849,6 +1002,18 @@ func parseVia(b []byte) ([]Header, error) {
 					pos = pos + 6
 					continue
 				}
+				// Look for an Rport identifier without a value
+				if getString(b, pos, pos+5) == "rport" && (pos+5 == len(b) || b[pos+5] == ';') {
+					rportRequested = true
+					pos = pos + 5
+					continue
+				}
+				// Look for an alias identifier
+				if getString(b, pos, pos+5) == "alias" && (pos+5 == len(b) || b[pos+5] == ';') {
+					alias = true
+					pos = pos + 5
+					continue
+				}
 				// Look for a maddr identifier
 				if getString(b, pos, pos+6) == "maddr=" {
 					state = FieldMaddr
@@ -942,10 +1107,12 @@ func parseVia(b []byte) ([]Header, error) {
 	result.Port = string(port)
 	result.Branch = string(branch)
 	result.Rport = string(rport)
+	result.RportRequested = rportRequested
+	result.Alias = alias
 	result.Maddr = string(maddr)
 	result.TTL = string(ttl)
 	result.Received = string(received)
-	return []Header{&result}, nil
+	return &result
 }
 
 func parseMaxForwards(b []byte) ([]Header, error) {
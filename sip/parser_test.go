@@ -31,3 +31,86 @@ func TestParser(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+func TestParserInvalidHeader(t *testing.T) {
+	msg, err := Parse([]byte("OPTIONS sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"Max-Forwards: seventy\r\n" +
+		"CSeq: 63104 OPTIONS\r\n\r\n"))
+	assert.NotNil(t, err)
+	assert.NotNil(t, msg)
+
+	cseq, ok := msg.CSeq()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(63104), cseq.Sequence)
+
+	_, err = Parse([]byte("hello world\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidStartLine)
+}
+
+func TestParserViaList(t *testing.T) {
+	msg, err := Parse([]byte("SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP a.example.com;branch=z9hG4bK1, SIP/2.0/TCP b.example.com:5070;branch=z9hG4bK2\r\n" +
+		"Via: SIP/2.0/UDP c.example.com;branch=z9hG4bK3\r\n" +
+		"CSeq: 63104 OPTIONS\r\n\r\n"))
+	assert.Nil(t, err)
+
+	vias, ok := msg.Via()
+	assert.True(t, ok)
+	assert.Len(t, vias, 3)
+	assert.Equal(t, "a.example.com", vias[0].Host)
+	assert.Equal(t, "z9hG4bK1", vias[0].Branch)
+	assert.Equal(t, "tcp", vias[1].Transport)
+	assert.Equal(t, "b.example.com", vias[1].Host)
+	assert.Equal(t, "5070", vias[1].Port)
+	assert.Equal(t, "z9hG4bK2", vias[1].Branch)
+	assert.Equal(t, "z9hG4bK3", vias[2].Branch)
+}
+
+func TestParserContactOb(t *testing.T) {
+	msg, err := Parse([]byte("REGISTER sip:example.com SIP/2.0\r\n" +
+		"Contact: <sip:alice@192.0.2.1:5060;transport=tcp;ob>;expires=3600\r\n" +
+		"CSeq: 1 REGISTER\r\n\r\n"))
+	assert.Nil(t, err)
+
+	contact, ok := msg.Contact()
+	assert.True(t, ok)
+	assert.True(t, contact.Ob)
+	assert.Equal(t, "tcp", contact.Transport)
+	assert.Equal(t, 3600, contact.Expires)
+	assert.Equal(t, "<sip:alice@192.0.2.1:5060;transport=tcp;ob>;expires=3600", contact.String())
+
+	msg, err = Parse([]byte("REGISTER sip:example.com SIP/2.0\r\n" +
+		"Contact: \"Bob\" <sip:bob@192.0.2.2;obscure=1>\r\n" +
+		"CSeq: 1 REGISTER\r\n\r\n"))
+	assert.Nil(t, err)
+	contact, _ = msg.Contact()
+	assert.False(t, contact.Ob)
+}
+
+func TestParserContactURIParameters(t *testing.T) {
+	msg, err := Parse([]byte("SIP/2.0 200 OK\r\n" +
+		"Contact: <sip:+15551234567@edge.biloxi.com;user=phone;maddr=192.0.2.7;lr>;q=0.5\r\n" +
+		"CSeq: 1 INVITE\r\n\r\n"))
+	assert.Nil(t, err)
+
+	contact, ok := msg.Contact()
+	assert.True(t, ok)
+	assert.Equal(t, "phone", contact.UserType)
+	assert.Equal(t, "192.0.2.7", contact.Maddr)
+	assert.True(t, contact.LR)
+	assert.Equal(t, "0.5", contact.Q)
+	assert.Equal(t, "<sip:+15551234567@edge.biloxi.com;user=phone;maddr=192.0.2.7;lr>;q=0.5", contact.String())
+}
+
+func TestParserRequestURIParameters(t *testing.T) {
+	msg, err := Parse([]byte("BYE sip:+15551234567@edge.biloxi.com;user=phone;maddr=192.0.2.7;ob SIP/2.0\r\n" +
+		"CSeq: 2 BYE\r\n\r\n"))
+	assert.Nil(t, err)
+
+	uri := msg.RequestURI()
+	assert.Equal(t, "phone", uri.UserType)
+	assert.Equal(t, "192.0.2.7", uri.Maddr)
+	assert.True(t, uri.Ob)
+	assert.Equal(t, "sip:+15551234567@edge.biloxi.com;user=phone;maddr=192.0.2.7;ob", NewRequest(MethodBye, uri).RequestURI().String())
+}
@@ -0,0 +1,131 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidURI = errors.New("sip: invalid URI")
+
+// URI identifies a communications resource, such as the Request-URI of a
+// request or the address of a Contact, From or To header field.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-19.1
+type URI struct {
+	Scheme    string
+	User      string
+	Host      string
+	Port      string
+	UserType  string
+	Transport string
+	Maddr     string
+	// LR is set when the URI has the "lr" parameter, which marks a proxy as
+	// a loose router.
+	LR bool
+	// Ob is set when the URI has the "ob" parameter, which marks a Contact or
+	// Path URI as supporting SIP Outbound.
+	//
+	// See: https://datatracker.ietf.org/doc/html/rfc5626#section-5.4
+	Ob bool
+}
+
+// ParseURI parses a SIP or SIPS URI. The URI may be enclosed in angle
+// brackets and preceded by a display name, as in a Route header field value.
+// Header parameters after the closing bracket are ignored.
+func ParseURI(s string) (URI, error) {
+	var uri URI
+
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '<'); i >= 0 {
+		j := strings.IndexByte(s[i:], '>')
+		if j < 0 {
+			return uri, ErrInvalidURI
+		}
+		s = s[i+1 : i+j]
+	}
+
+	scheme, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return uri, ErrInvalidURI
+	}
+	uri.Scheme = strings.ToLower(scheme)
+
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		rest = rest[:i]
+	}
+
+	params := strings.Split(rest, ";")
+	hostport := params[0]
+	if i := strings.LastIndexByte(hostport, '@'); i >= 0 {
+		uri.User, hostport = hostport[:i], hostport[i+1:]
+	}
+
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return uri, ErrInvalidURI
+		}
+		uri.Host, hostport = hostport[1:end], hostport[end+1:]
+		uri.Port = strings.TrimPrefix(hostport, ":")
+	} else {
+		uri.Host, uri.Port, _ = strings.Cut(hostport, ":")
+	}
+	if uri.Host == "" {
+		return uri, ErrInvalidURI
+	}
+
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "transport":
+			uri.Transport = strings.ToLower(value)
+		case "user":
+			uri.UserType = value
+		case "maddr":
+			uri.Maddr = value
+		case "lr":
+			uri.LR = true
+		case "ob":
+			uri.Ob = true
+		}
+	}
+
+	return uri, nil
+}
+
+func (u URI) String() string {
+	var sb strings.Builder
+
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "sip"
+	}
+	sb.WriteString(scheme + ":")
+	if u.User != "" {
+		sb.WriteString(u.User + "@")
+	}
+	if strings.Contains(u.Host, ":") {
+		sb.WriteString("[" + u.Host + "]")
+	} else {
+		sb.WriteString(u.Host)
+	}
+	if u.Port != "" {
+		sb.WriteString(":" + u.Port)
+	}
+	if u.UserType != "" {
+		sb.WriteString(";user=" + u.UserType)
+	}
+	if u.Transport != "" {
+		sb.WriteString(";transport=" + u.Transport)
+	}
+	if u.Maddr != "" {
+		sb.WriteString(";maddr=" + u.Maddr)
+	}
+	if u.LR {
+		sb.WriteString(";lr")
+	}
+	if u.Ob {
+		sb.WriteString(";ob")
+	}
+	return sb.String()
+}
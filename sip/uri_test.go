@@ -0,0 +1,49 @@
+package sip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		Input    string
+		Expected URI
+	}{
+		{
+			Input:    "sip:bob@biloxi.com",
+			Expected: URI{Scheme: "sip", User: "bob", Host: "biloxi.com"},
+		},
+		{
+			Input:    "<sip:p1.example.com;lr>",
+			Expected: URI{Scheme: "sip", Host: "p1.example.com", LR: true},
+		},
+		{
+			Input:    "\"Proxy\" <sips:192.0.2.4:5061;transport=TCP;maddr=239.255.255.1>;foo=bar",
+			Expected: URI{Scheme: "sips", Host: "192.0.2.4", Port: "5061", Transport: "tcp", Maddr: "239.255.255.1"},
+		},
+		{
+			Input:    "<sip:AQIDBAUGBwg@edge.example.com;lr;ob>",
+			Expected: URI{Scheme: "sip", User: "AQIDBAUGBwg", Host: "edge.example.com", LR: true, Ob: true},
+		},
+		{
+			Input:    "sip:alice@[2001:db8::10]:5070;user=phone",
+			Expected: URI{Scheme: "sip", User: "alice", Host: "2001:db8::10", Port: "5070", UserType: "phone"},
+		},
+	}
+
+	for _, test := range tests {
+		uri, err := ParseURI(test.Input)
+		assert.Nil(t, err)
+		assert.Equal(t, test.Expected, uri)
+	}
+
+	_, err := ParseURI("biloxi.com")
+	assert.ErrorIs(t, err, ErrInvalidURI)
+}
+
+func TestURIString(t *testing.T) {
+	uri := URI{Scheme: "sip", User: "alice", Host: "2001:db8::10", Port: "5070", LR: true}
+	assert.Equal(t, "sip:alice@[2001:db8::10]:5070;lr", uri.String())
+}
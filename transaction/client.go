@@ -0,0 +1,555 @@
+package transaction
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transport"
+)
+
+// ClientTransaction is a client transaction. It sends a request, retransmits
+// it over unreliable transports until a response arrives, and passes the
+// responses on to the transaction user.
+//
+// Responses have to be handed to the transaction with Receive.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1
+type ClientTransaction struct {
+	mu        sync.Mutex
+	tp        Transport
+	req       sip.Message
+	ack       sip.Message
+	invite    bool
+	opts      options
+	obs       observer
+	reliable  bool
+	state     State
+	err       error
+	interval  time.Duration
+	responses chan sip.Message
+	done      chan struct{}
+
+	// targets are the targets located for the request if tp is a Locator.
+	// The first is the one the request was sent to.
+	targets []transport.Target
+	// rekey is called when the transaction moves to the next target under
+	// a new key.
+	rekey func(from, to Key)
+
+	// cancel sends a CANCEL once a provisional response arrives. canceled
+	// is set once the INVITE is to be cancelled, after which it is not sent
+	// to another target.
+	cancel   func()
+	canceled bool
+
+	// retransmit is Timer A or E, timeout is Timer B or F and linger is
+	// Timer D or K or, in the Accepted state, Timer M.
+	retransmit Timer
+	timeout    Timer
+	linger     Timer
+}
+
+// NewClientTransaction starts a client transaction for req and sends it over
+// tp. A Via header field is added to the request if it has none, and a branch
+// parameter if the top Via has none.
+//
+// ACK requests do not start a transaction and are rejected with ErrMethod.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.1
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.2
+func NewClientTransaction(tp Transport, req sip.Message, opts ...Option) (*ClientTransaction, error) {
+	return newClientTransaction(tp, req, newOptions(opts))
+}
+
+func newClientTransaction(tp Transport, req sip.Message, o options) (*ClientTransaction, error) {
+	tx, err := prepareClientTransaction(tp, req, o)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.start(); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// prepareClientTransaction creates a client transaction without sending the
+// request, so that it can be registered under its key first.
+func prepareClientTransaction(tp Transport, req sip.Message, o options) (*ClientTransaction, error) {
+	if req.Method() == sip.MethodAck {
+		return nil, ErrMethod
+	}
+	if _, ok := req.CSeq(); !ok {
+		return nil, ErrNoCSeq
+	}
+
+	vias, ok := req.Via()
+	if !ok {
+		req.AppendHeader(&sip.Via{Transport: "udp", Branch: NewBranch()})
+		vias, _ = req.Via()
+	}
+	if vias[0].Branch == "" {
+		vias[0].Branch = NewBranch()
+	}
+	key, err := ClientKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &ClientTransaction{
+		tp:        tp,
+		req:       req,
+		invite:    req.Method() == sip.MethodInvite,
+		opts:      o,
+		state:     StateTrying,
+		responses: make(chan sip.Message, responseBufferSize),
+		done:      make(chan struct{}),
+		obs:       newObserver(o, key, req.Method(), false),
+	}
+	if tx.invite {
+		tx.state = StateCalling
+	}
+	return tx, nil
+}
+
+// start sends the request and starts the timers. The transaction terminates
+// if the request cannot be sent.
+func (tx *ClientTransaction) start() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.state == StateTerminated {
+		return ErrTerminated
+	}
+	tx.obs.emit(Event{Kind: EventCreated, State: tx.state, From: tx.state})
+	if err := tx.locate(); err != nil {
+		return err
+	}
+	if err := tx.sendRequest(); err != nil {
+		return err
+	}
+	tx.startTimers()
+	return nil
+}
+
+// startTimers starts the timers of the request once it has been sent.
+func (tx *ClientTransaction) startTimers() {
+	// The transport sets the transport of the top Via to the one the
+	// request was sent over.
+	vias, _ := tx.req.Via()
+	tx.reliable = isReliable(vias[0].Transport)
+
+	if !tx.reliable {
+		tx.interval = tx.opts.t1
+		tx.retransmit = tx.opts.clock.AfterFunc(tx.interval, tx.fireRetransmit)
+	}
+	timeout := tx.opts.f
+	if tx.invite {
+		timeout = tx.opts.b
+	}
+	tx.timeout = tx.opts.clock.AfterFunc(timeout, tx.fireTimeout)
+}
+
+// Key returns the key of the transaction. It changes when the request is
+// sent to the next target.
+func (tx *ClientTransaction) Key() Key {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.obs.key
+}
+
+// Request returns the request of the transaction.
+func (tx *ClientTransaction) Request() sip.Message {
+	return tx.req
+}
+
+// Responses returns a channel of the responses to pass on to the transaction
+// user. It is closed when the transaction terminates.
+func (tx *ClientTransaction) Responses() <-chan sip.Message {
+	return tx.responses
+}
+
+// Done returns a channel that is closed when the transaction terminates.
+func (tx *ClientTransaction) Done() <-chan struct{} {
+	return tx.done
+}
+
+// Err returns why the transaction terminated: ErrTimeout if no final
+// response arrived in time, ErrTerminated if Terminate was called, the error
+// of the transport if a retransmission failed, and nil otherwise.
+func (tx *ClientTransaction) Err() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.err
+}
+
+// State returns the state of the transaction.
+func (tx *ClientTransaction) State() State {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.state
+}
+
+// Terminate terminates the transaction without waiting for its timers.
+func (tx *ClientTransaction) Terminate() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.terminate(ErrTerminated)
+}
+
+// Receive hands a response that matches the transaction to it.
+//
+// Provisional responses move the transaction to Proceeding and are passed
+// on. The first final response is passed on and moves the transaction to
+// Completed, or to Accepted for a 2xx response to an INVITE; retransmissions
+// of it are absorbed, except for 2xx responses to an INVITE.
+//
+// A 503 Service Unavailable is not passed on while there are other located
+// targets: the request is sent to the next one instead.
+func (tx *ClientTransaction) Receive(res sip.Message) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if res.StatusCode() == sip.StatusServiceUnavailable && tx.failover(res) {
+		return
+	}
+	if tx.invite {
+		tx.receiveInvite(res)
+	} else {
+		tx.receive(res)
+	}
+}
+
+// receiveInvite acknowledges 300-699 responses, including retransmissions.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.1.2
+// See: https://datatracker.ietf.org/doc/html/rfc6026#section-7.2
+func (tx *ClientTransaction) receiveInvite(res sip.Message) {
+	code := res.StatusCode()
+	switch tx.state {
+	case StateCalling, StateProceeding:
+		switch {
+		case code < 200:
+			stopTimers(tx.retransmit, tx.timeout)
+			tx.setState(StateProceeding)
+			tx.deliver(res)
+			if tx.cancel != nil {
+				go tx.cancel()
+				tx.cancel = nil
+			}
+		case code < 300:
+			stopTimers(tx.retransmit, tx.timeout)
+			tx.setState(StateAccepted)
+			tx.deliver(res)
+			tx.linger = tx.opts.clock.AfterFunc(64*tx.opts.t1, tx.fireLinger)
+		default:
+			stopTimers(tx.retransmit, tx.timeout)
+			tx.setState(StateCompleted)
+			tx.ack = tx.buildAck(res)
+			if err := tx.send(tx.ack); err != nil {
+				return
+			}
+			tx.deliver(res)
+			if tx.reliable {
+				tx.terminate(nil)
+				return
+			}
+			tx.linger = tx.opts.clock.AfterFunc(tx.opts.d, tx.fireLinger)
+		}
+	case StateAccepted:
+		if code >= 200 && code < 300 {
+			tx.deliver(res)
+		}
+	case StateCompleted:
+		if code >= 300 {
+			if err := tx.send(tx.ack); err == nil {
+				tx.obs.emit(Event{Kind: EventRetransmitted, State: tx.state, From: tx.state, Message: tx.ack})
+			}
+		}
+	}
+}
+
+// receive handles a response to a non-INVITE request.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.2.2
+func (tx *ClientTransaction) receive(res sip.Message) {
+	if tx.state != StateTrying && tx.state != StateProceeding {
+		return
+	}
+
+	if res.StatusCode() < 200 {
+		tx.setState(StateProceeding)
+		tx.deliver(res)
+		return
+	}
+
+	stopTimers(tx.retransmit, tx.timeout)
+	tx.setState(StateCompleted)
+	tx.deliver(res)
+	if tx.reliable {
+		tx.terminate(nil)
+		return
+	}
+	tx.linger = tx.opts.clock.AfterFunc(tx.opts.t4, tx.fireLinger)
+}
+
+// failover sends the request to the next located target after a 503
+// response from the current one, in a new transaction with a new branch. The
+// 503 to an INVITE is acknowledged first. It reports false if there is no
+// other target, the response is a retransmission or the INVITE is being
+// cancelled.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3263#section-4.3
+func (tx *ClientTransaction) failover(res sip.Message) bool {
+	if len(tx.targets) < 2 || tx.canceled {
+		return false
+	}
+	switch tx.state {
+	case StateCalling, StateTrying, StateProceeding:
+	default:
+		return false
+	}
+
+	stopTimers(tx.retransmit, tx.timeout)
+	if tx.invite {
+		_ = tx.tp.(Locator).SendTo(tx.buildAck(res), tx.targets[0])
+	}
+	tx.targets = tx.targets[1:]
+
+	vias, _ := tx.req.Via()
+	vias[0].Branch = NewBranch()
+	from := tx.obs.key
+	tx.obs.key, _ = ClientKey(tx.req)
+	if tx.rekey != nil {
+		tx.rekey(from, tx.obs.key)
+	}
+
+	if tx.invite {
+		tx.setState(StateCalling)
+	} else {
+		tx.setState(StateTrying)
+	}
+	if err := tx.sendRequest(); err != nil {
+		return true
+	}
+	tx.startTimers()
+	return true
+}
+
+// buildCancel builds a CANCEL for the request of the transaction. It has the
+// same branch as the request, so that it matches the server transaction of
+// the request at the next hop.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-9.1
+func (tx *ClientTransaction) buildCancel() sip.Message {
+	cancel := sip.NewRequest(sip.MethodCancel, tx.req.RequestURI())
+
+	vias, _ := tx.req.Via()
+	via := *vias[0]
+	cancel.AppendHeader(&via)
+	for _, route := range tx.req.GetHeaders("route") {
+		cancel.AppendHeader(route)
+	}
+	cancel.AppendHeader(sip.MaxForwards(70))
+	if from, ok := tx.req.From(); ok {
+		f := *from
+		cancel.AppendHeader(&f)
+	}
+	if to, ok := tx.req.To(); ok {
+		t := *to
+		cancel.AppendHeader(&t)
+	}
+	if callID, ok := tx.req.CallID(); ok {
+		cancel.AppendHeader(*callID)
+	}
+	cseq, _ := tx.req.CSeq()
+	cancel.AppendHeader(&sip.CSeq{Sequence: cseq.Sequence, Method: sip.MethodCancel})
+
+	return cancel
+}
+
+// buildAck builds the ACK for a 300-699 response to the request of the
+// transaction.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.1.3
+func (tx *ClientTransaction) buildAck(res sip.Message) sip.Message {
+	ack := sip.NewRequest(sip.MethodAck, tx.req.RequestURI())
+
+	vias, _ := tx.req.Via()
+	via := *vias[0]
+	ack.AppendHeader(&via)
+	for _, route := range tx.req.GetHeaders("route") {
+		ack.AppendHeader(route)
+	}
+	ack.AppendHeader(sip.MaxForwards(70))
+	if from, ok := tx.req.From(); ok {
+		f := *from
+		ack.AppendHeader(&f)
+	}
+	if to, ok := res.To(); ok {
+		t := *to
+		ack.AppendHeader(&t)
+	}
+	if callID, ok := tx.req.CallID(); ok {
+		ack.AppendHeader(*callID)
+	}
+	cseq, _ := tx.req.CSeq()
+	ack.AppendHeader(&sip.CSeq{Sequence: cseq.Sequence, Method: sip.MethodAck})
+
+	return ack
+}
+
+// fireRetransmit retransmits the request and doubles the interval. The
+// interval of a non-INVITE request is capped at T2, and is T2 once a
+// provisional response has arrived.
+func (tx *ClientTransaction) fireRetransmit() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if !tx.pending() {
+		return
+	}
+	if err := tx.send(tx.req); err != nil {
+		return
+	}
+	tx.obs.emit(Event{Kind: EventRetransmitted, State: tx.state, From: tx.state, Message: tx.req})
+	tx.interval *= 2
+	if !tx.invite && (tx.interval > tx.opts.t2 || tx.state == StateProceeding) {
+		tx.interval = tx.opts.t2
+	}
+	tx.retransmit = tx.opts.clock.AfterFunc(tx.interval, tx.fireRetransmit)
+}
+
+// fireTimeout informs the transaction user that no response arrived by
+// passing on a 408 Request Timeout.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-8.1.3.1
+func (tx *ClientTransaction) fireTimeout() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if !tx.pending() {
+		return
+	}
+	tx.obs.emit(Event{Kind: EventTimeout, State: tx.state, From: tx.state, Err: ErrTimeout})
+	tx.deliver(sip.NewResponse(tx.req, sip.StatusRequestTimeout, ""))
+	tx.terminate(ErrTimeout)
+}
+
+func (tx *ClientTransaction) fireLinger() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.state != StateCompleted && tx.state != StateAccepted {
+		return
+	}
+	tx.terminate(nil)
+}
+
+// pending reports whether the transaction is waiting for a final response
+// and still retransmits the request over unreliable transports. An INVITE
+// transaction stops retransmitting once a provisional response arrives.
+func (tx *ClientTransaction) pending() bool {
+	if tx.invite {
+		return tx.state == StateCalling
+	}
+	return tx.state == StateTrying || tx.state == StateProceeding
+}
+
+// deliver passes res on to the transaction user, dropping it if the
+// transaction user does not keep up.
+func (tx *ClientTransaction) deliver(res sip.Message) {
+	select {
+	case tx.responses <- res:
+	default:
+	}
+}
+
+// locate locates the targets of the request if the transport is a Locator,
+// terminating the transaction if there are none.
+func (tx *ClientTransaction) locate() error {
+	loc, ok := tx.tp.(Locator)
+	if !ok || tx.targets != nil {
+		return nil
+	}
+	targets, err := loc.Locate(context.Background(), tx.req)
+	if err == nil && len(targets) == 0 {
+		err = transport.ErrNoTargets
+	}
+	if err != nil {
+		tx.obs.emit(Event{Kind: EventTransportError, State: tx.state, From: tx.state, Message: tx.req, Err: err})
+		tx.terminate(err)
+		return err
+	}
+	tx.targets = targets
+	return nil
+}
+
+// target returns the target the request was sent to, or nil if the targets
+// were not located. It must be called with tx.mu held.
+func (tx *ClientTransaction) target() []transport.Target {
+	if len(tx.targets) == 0 {
+		return nil
+	}
+	return tx.targets[:1:1]
+}
+
+// sendRequest sends the request to the located targets in order until one
+// accepts it, and keeps that one for the rest of the transaction.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3263#section-4.3
+func (tx *ClientTransaction) sendRequest() error {
+	for len(tx.targets) > 1 {
+		err := tx.tp.(Locator).SendTo(tx.req, tx.targets[0])
+		if err == nil {
+			return nil
+		}
+		tx.obs.emit(Event{Kind: EventTransportError, State: tx.state, From: tx.state, Message: tx.req, Err: err})
+		tx.targets = tx.targets[1:]
+	}
+	return tx.send(tx.req)
+}
+
+// send sends msg over the transport, to the target of the request if the
+// targets were located, terminating the transaction if it fails.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.4
+func (tx *ClientTransaction) send(msg sip.Message) error {
+	var err error
+	if len(tx.targets) > 0 {
+		err = tx.tp.(Locator).SendTo(msg, tx.targets[0])
+	} else {
+		err = tx.tp.Send(msg)
+	}
+	if err != nil {
+		tx.obs.emit(Event{Kind: EventTransportError, State: tx.state, From: tx.state, Message: msg, Err: err})
+		tx.terminate(err)
+		return err
+	}
+	return nil
+}
+
+func (tx *ClientTransaction) setState(state State) {
+	from := tx.state
+	tx.state = state
+	tx.obs.emit(Event{Kind: EventStateChanged, State: state, From: from})
+}
+
+// terminate moves the transaction to Terminated. It must be called with tx.mu
+// held.
+func (tx *ClientTransaction) terminate(err error) {
+	if tx.state == StateTerminated {
+		return
+	}
+	stopTimers(tx.retransmit, tx.timeout, tx.linger)
+	tx.err = err
+	tx.setState(StateTerminated)
+	close(tx.responses)
+	close(tx.done)
+	tx.obs.emit(Event{Kind: EventTerminated, State: StateTerminated, From: StateTerminated, Err: err})
+}
@@ -0,0 +1,373 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/clock"
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTransport records the messages sent over it and sets the transport of
+// the top Via of requests like a transport layer does.
+type fakeTransport struct {
+	mu        sync.Mutex
+	transport string
+	sent      []sip.Message
+	err       error
+}
+
+func (tp *fakeTransport) Send(msg sip.Message) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if tp.err != nil {
+		return tp.err
+	}
+	if vias, ok := msg.Via(); ok && sip.IsRequest(msg) {
+		vias[0].Transport = tp.transport
+	}
+	tp.sent = append(tp.sent, msg)
+	return nil
+}
+
+func (tp *fakeTransport) Sent() []sip.Message {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	return append([]sip.Message(nil), tp.sent...)
+}
+
+// locatingTransport is a fakeTransport that is a Locator. It records the
+// target of each message and fails to send to the targets in down.
+type locatingTransport struct {
+	fakeTransport
+	targets []transport.Target
+	down    map[int]bool
+	located int
+	sentTo  []transport.Target
+}
+
+func (tp *locatingTransport) Locate(ctx context.Context, msg sip.Message) ([]transport.Target, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.located++
+	return append([]transport.Target(nil), tp.targets...), nil
+}
+
+func (tp *locatingTransport) SendTo(msg sip.Message, target transport.Target) error {
+	tp.mu.Lock()
+	down := tp.down[target.Port]
+	tp.mu.Unlock()
+	if down {
+		return errors.New("connection refused")
+	}
+
+	if err := tp.Send(msg); err != nil {
+		return err
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.sentTo = append(tp.sentTo, target)
+	return nil
+}
+
+func (tp *locatingTransport) SentTo() []transport.Target {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	return append([]transport.Target(nil), tp.sentTo...)
+}
+
+func newClock() *clock.Fake {
+	return clock.NewFake(time.Unix(0, 0))
+}
+
+func testRequest(t *testing.T, method string) sip.Message {
+	req, err := sip.Parse([]byte(method + " sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds\r\n" +
+		"Route: <sip:proxy.atlanta.com;lr>\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: Bob <sip:bob@biloxi.com>\r\n" +
+		"From: Alice <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 314159 " + method + "\r\n\r\n"))
+	assert.Nil(t, err)
+	return req
+}
+
+func testResponse(t *testing.T, req sip.Message, code int) sip.Message {
+	res := sip.NewResponse(req, code, "")
+	if code > 100 {
+		to, _ := res.To()
+		to.Tag = "a6c85cf"
+	}
+	return res
+}
+
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestClientTransactionRetransmitsInvite(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+	defer tx.Terminate()
+
+	// Timer A fires after T1, 3*T1 and 7*T1.
+	clock.Advance(3 * T1)
+	assert.Len(t, tp.Sent(), 3)
+	clock.Advance(4 * T1)
+	assert.Len(t, tp.Sent(), 4)
+	assert.Equal(t, StateCalling, tx.State())
+
+	tx.Receive(testResponse(t, tx.Request(), sip.StatusTrying))
+	assert.Equal(t, StateProceeding, tx.State())
+	assert.Equal(t, sip.StatusTrying, (<-tx.Responses()).StatusCode())
+
+	clock.Advance(time.Minute)
+	assert.Len(t, tp.Sent(), 4)
+	assert.Equal(t, StateProceeding, tx.State())
+}
+
+func TestClientTransactionReliable(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "tcp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+
+	clock.Advance(10 * T1)
+	assert.Len(t, tp.Sent(), 1)
+
+	// Timer D is zero over reliable transports.
+	tx.Receive(testResponse(t, tx.Request(), sip.StatusBusyHere))
+	assert.Equal(t, StateTerminated, tx.State())
+	assert.Nil(t, tx.Err())
+	assert.Len(t, tp.Sent(), 2)
+}
+
+func TestClientTransactionTimeout(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+
+	clock.Advance(64*T1 - time.Millisecond)
+	assert.False(t, isDone(tx.Done()))
+	clock.Advance(time.Millisecond)
+	assert.True(t, isDone(tx.Done()))
+
+	res, ok := <-tx.Responses()
+	assert.True(t, ok)
+	assert.Equal(t, sip.StatusRequestTimeout, res.StatusCode())
+	assert.Equal(t, ErrTimeout, tx.Err())
+	assert.Equal(t, StateTerminated, tx.State())
+}
+
+func TestClientTransactionTimers(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	timers := WithTimers(Timers{T1: time.Second, B: 10 * time.Second})
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock), timers)
+	assert.Nil(t, err)
+
+	// Timer A fires after 1 s, 3 s and 7 s.
+	clock.Advance(7 * time.Second)
+	assert.Len(t, tp.Sent(), 4)
+	assert.False(t, isDone(tx.Done()))
+	clock.Advance(3 * time.Second)
+	assert.Equal(t, ErrTimeout, tx.Err())
+
+	// Timer F defaults to 64*T1.
+	tx, err = NewClientTransaction(tp, testRequest(t, sip.MethodOptions), WithClock(clock), timers)
+	assert.Nil(t, err)
+	clock.Advance(63 * time.Second)
+	assert.False(t, isDone(tx.Done()))
+	clock.Advance(time.Second)
+	assert.Equal(t, ErrTimeout, tx.Err())
+}
+
+func TestClientTransactionAcknowledgesFailure(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+
+	res := testResponse(t, tx.Request(), sip.StatusBusyHere)
+	tx.Receive(res)
+	assert.Equal(t, StateCompleted, tx.State())
+	assert.Equal(t, sip.StatusBusyHere, (<-tx.Responses()).StatusCode())
+
+	sent := tp.Sent()
+	ack := sent[len(sent)-1]
+	assert.Equal(t, sip.MethodAck, ack.Method())
+	assert.Equal(t, tx.Request().RequestURI(), ack.RequestURI())
+
+	reqVias, _ := tx.Request().Via()
+	ackVias, _ := ack.Via()
+	assert.Len(t, ackVias, 1)
+	assert.Equal(t, reqVias[0].Branch, ackVias[0].Branch)
+
+	to, _ := ack.To()
+	assert.Equal(t, "a6c85cf", to.Tag)
+	from, _ := ack.From()
+	assert.Equal(t, "1928301774", from.Tag)
+	cseq, _ := ack.CSeq()
+	assert.Equal(t, sip.CSeq{Sequence: 314159, Method: sip.MethodAck}, *cseq)
+	callID, _ := ack.CallID()
+	assert.Equal(t, "a84b4c76e66710@pc33.atlanta.com", string(*callID))
+	assert.Len(t, ack.GetHeaders("route"), 1)
+
+	// A retransmission of the response is acknowledged but absorbed.
+	tx.Receive(res)
+	assert.Len(t, tp.Sent(), len(sent)+1)
+
+	clock.Advance(32 * time.Second)
+	assert.True(t, isDone(tx.Done()))
+	_, ok := <-tx.Responses()
+	assert.False(t, ok)
+	assert.Nil(t, tx.Err())
+}
+
+func TestClientTransactionPinsTarget(t *testing.T) {
+	clock := newClock()
+	tp := &locatingTransport{
+		fakeTransport: fakeTransport{transport: "udp"},
+		targets: []transport.Target{
+			{Transport: "udp", IP: net.IPv4(192, 0, 2, 1), Port: 5060},
+			{Transport: "udp", IP: net.IPv4(192, 0, 2, 2), Port: 5070},
+			{Transport: "udp", IP: net.IPv4(192, 0, 2, 3), Port: 5080},
+		},
+		down: map[int]bool{5060: true},
+	}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+
+	// The request goes to the first target that accepts it, and so do the
+	// retransmissions and the ACK.
+	clock.Advance(3 * T1)
+	tx.Receive(testResponse(t, tx.Request(), sip.StatusBusyHere))
+	assert.Equal(t, StateCompleted, tx.State())
+
+	sent := tp.Sent()
+	assert.Len(t, sent, 4)
+	assert.Equal(t, sip.MethodAck, sent[3].Method())
+	for _, target := range tp.SentTo() {
+		assert.Equal(t, 5070, target.Port)
+	}
+	assert.Equal(t, 1, tp.located)
+}
+
+func TestClientTransactionAccepted(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+
+	tx.Receive(testResponse(t, tx.Request(), sip.StatusOK))
+	assert.Equal(t, StateAccepted, tx.State())
+
+	// Retransmissions of the 2xx are passed on so that the transaction user
+	// can acknowledge them.
+	tx.Receive(testResponse(t, tx.Request(), sip.StatusOK))
+	assert.Equal(t, sip.StatusOK, (<-tx.Responses()).StatusCode())
+	assert.Equal(t, sip.StatusOK, (<-tx.Responses()).StatusCode())
+	assert.Len(t, tp.Sent(), 1)
+
+	// Timer M.
+	clock.Advance(64 * T1)
+	assert.True(t, isDone(tx.Done()))
+	assert.Nil(t, tx.Err())
+}
+
+func TestClientTransactionRejectsAck(t *testing.T) {
+	_, err := NewClientTransaction(&fakeTransport{}, testRequest(t, sip.MethodAck))
+	assert.Equal(t, ErrMethod, err)
+}
+
+func TestClientTransactionCapsRetransmitInterval(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodRegister), WithClock(clock))
+	assert.Nil(t, err)
+	defer tx.Terminate()
+	assert.Equal(t, StateTrying, tx.State())
+
+	// Timer E fires after 0.5, 1.5, 3.5, 7.5 and 11.5 s.
+	clock.Advance(11500 * time.Millisecond)
+	assert.Len(t, tp.Sent(), 6)
+
+	tx.Receive(testResponse(t, tx.Request(), sip.StatusTrying))
+	assert.Equal(t, StateProceeding, tx.State())
+	assert.Equal(t, sip.StatusTrying, (<-tx.Responses()).StatusCode())
+
+	// In Proceeding the request is retransmitted every T2.
+	clock.Advance(2 * T2)
+	assert.Len(t, tp.Sent(), 8)
+}
+
+func TestClientTransactionNonInviteTimeout(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "tcp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodOptions), WithClock(clock))
+	assert.Nil(t, err)
+
+	tx.Receive(testResponse(t, tx.Request(), sip.StatusTrying))
+	<-tx.Responses()
+
+	// Timer F keeps running in Proceeding.
+	clock.Advance(64 * T1)
+	assert.True(t, isDone(tx.Done()))
+
+	res, ok := <-tx.Responses()
+	assert.True(t, ok)
+	assert.Equal(t, sip.StatusRequestTimeout, res.StatusCode())
+	assert.Equal(t, ErrTimeout, tx.Err())
+	assert.Len(t, tp.Sent(), 1)
+}
+
+func TestClientTransactionAbsorbsRetransmittedResponses(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodBye), WithClock(clock))
+	assert.Nil(t, err)
+
+	res := testResponse(t, tx.Request(), sip.StatusOK)
+	tx.Receive(res)
+	assert.Equal(t, StateCompleted, tx.State())
+	tx.Receive(res)
+
+	// Timer K.
+	clock.Advance(T4)
+	assert.True(t, isDone(tx.Done()))
+
+	var codes []int
+	for res := range tx.Responses() {
+		codes = append(codes, res.StatusCode())
+	}
+	assert.Equal(t, []int{sip.StatusOK}, codes)
+	assert.Len(t, tp.Sent(), 1)
+	assert.Nil(t, tx.Err())
+}
+
+func TestNewBranch(t *testing.T) {
+	a, b := NewBranch(), NewBranch()
+	assert.True(t, len(a) > len(MagicCookie))
+	assert.Equal(t, MagicCookie, a[:len(MagicCookie)])
+	assert.NotEqual(t, a, b)
+}
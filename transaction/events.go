@@ -0,0 +1,115 @@
+package transaction
+
+import (
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// EventKind is the kind of an Event.
+type EventKind int
+
+const (
+	// EventCreated is emitted when a transaction starts.
+	EventCreated EventKind = iota
+	// EventStateChanged is emitted when a transaction moves to another
+	// state, including Terminated.
+	EventStateChanged
+	// EventRetransmitted is emitted when a request or response is sent
+	// again, either by a retransmission timer or to answer a retransmission
+	// of the peer.
+	EventRetransmitted
+	// EventTimeout is emitted when Timer B, F or H fires.
+	EventTimeout
+	// EventTransportError is emitted when a message of a transaction cannot
+	// be sent.
+	EventTransportError
+	// EventTerminated is emitted once a transaction has terminated.
+	EventTerminated
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventCreated:
+		return "created"
+	case EventStateChanged:
+		return "state changed"
+	case EventRetransmitted:
+		return "retransmitted"
+	case EventTimeout:
+		return "timeout"
+	case EventTransportError:
+		return "transport error"
+	case EventTerminated:
+		return "terminated"
+	}
+	return "unknown"
+}
+
+// Event describes something that happened to a transaction.
+type Event struct {
+	Kind EventKind
+	// Key identifies the transaction.
+	Key Key
+	// Method is the method of the request of the transaction.
+	Method string
+	// Server is set for server transactions.
+	Server bool
+	// State is the state of the transaction after the event, and From the
+	// state before it.
+	State State
+	From  State
+	// Time is the time of the event, and Elapsed the time since the
+	// transaction was created.
+	Time    time.Time
+	Elapsed time.Duration
+	// Message is the message that was retransmitted or could not be sent.
+	Message sip.Message
+	// Err is the error of a transport error, or the reason a transaction
+	// terminated.
+	Err error
+}
+
+// WithEvents sets a function that is called with the events of transactions.
+// It is called synchronously while the transaction is locked, so it must not
+// block or call methods of the transaction.
+func WithEvents(fn func(Event)) Option {
+	return func(o *options) {
+		o.events = fn
+	}
+}
+
+// observer emits the events of a transaction.
+type observer struct {
+	fn      func(Event)
+	clock   Clock
+	key     Key
+	method  string
+	server  bool
+	created time.Time
+}
+
+func newObserver(o options, key Key, method string, server bool) observer {
+	return observer{
+		fn:      o.events,
+		clock:   o.clock,
+		key:     key,
+		method:  method,
+		server:  server,
+		created: o.clock.Now(),
+	}
+}
+
+// emit fills in the fields that identify the transaction and calls the event
+// function.
+func (o *observer) emit(ev Event) {
+	if o.fn == nil {
+		return
+	}
+	ev.Key = o.key
+	ev.Method = o.method
+	ev.Server = o.server
+	ev.Time = o.clock.Now()
+	ev.Elapsed = ev.Time.Sub(o.created)
+	o.fn(ev)
+}
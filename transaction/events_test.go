@@ -0,0 +1,68 @@
+package transaction
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventsOfTimedOutTransaction(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{transport: "udp"}
+	var events []Event
+	tx, err := NewClientTransaction(tp, testRequest(t, sip.MethodInvite),
+		WithClock(clock), WithEvents(func(ev Event) { events = append(events, ev) }))
+	assert.Nil(t, err)
+
+	clock.Advance(64 * T1)
+
+	var kinds []EventKind
+	for _, ev := range events {
+		kinds = append(kinds, ev.Kind)
+		assert.Equal(t, tx.Key(), ev.Key)
+		assert.Equal(t, sip.MethodInvite, ev.Method)
+		assert.False(t, ev.Server)
+	}
+	// Timer A fires six times before Timer B.
+	assert.Equal(t, []EventKind{
+		EventCreated,
+		EventRetransmitted, EventRetransmitted, EventRetransmitted,
+		EventRetransmitted, EventRetransmitted, EventRetransmitted,
+		EventTimeout, EventStateChanged, EventTerminated,
+	}, kinds)
+
+	timeout := events[7]
+	assert.Equal(t, 64*T1, timeout.Elapsed)
+	assert.Equal(t, ErrTimeout, timeout.Err)
+
+	changed := events[8]
+	assert.Equal(t, StateCalling, changed.From)
+	assert.Equal(t, StateTerminated, changed.State)
+	assert.Equal(t, ErrTimeout, events[9].Err)
+}
+
+func TestEventsOfTransportError(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{}
+	var events []Event
+	tx, err := NewServerTransaction(tp, testRequest(t, sip.MethodOptions),
+		WithClock(clock), WithEvents(func(ev Event) { events = append(events, ev) }))
+	assert.Nil(t, err)
+
+	tp.err = errors.New("connection refused")
+	res := testResponse(t, tx.Request(), sip.StatusOK)
+	assert.Equal(t, tp.err, tx.Respond(res))
+
+	assert.Len(t, events, 4)
+	assert.Equal(t, EventCreated, events[0].Kind)
+	assert.Equal(t, StateTrying, events[0].State)
+	assert.True(t, events[0].Server)
+	assert.Equal(t, EventTransportError, events[1].Kind)
+	assert.Equal(t, res, events[1].Message)
+	assert.Equal(t, tp.err, events[1].Err)
+	assert.Equal(t, EventStateChanged, events[2].Kind)
+	assert.Equal(t, EventTerminated, events[3].Kind)
+	assert.Equal(t, tp.err, tx.Err())
+}
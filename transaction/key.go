@@ -0,0 +1,123 @@
+package transaction
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// Key identifies a transaction. Messages with the same key belong to the same
+// transaction.
+type Key struct {
+	// Branch is the branch parameter of the top Via.
+	Branch string
+	// SentBy is the sent-by address of the top Via. It is only set for server
+	// transactions, since branches are only unique per sender.
+	SentBy string
+	// Method is the method of the request that created the transaction.
+	Method string
+	// Legacy holds the fields that identify a server transaction whose
+	// request has a branch without the magic cookie, as sent by RFC 2543
+	// elements. It is empty otherwise.
+	Legacy string
+}
+
+// String returns the key in a form suitable for logging.
+func (k Key) String() string {
+	if k.Legacy != "" {
+		return k.Method + " " + k.Legacy
+	}
+	if k.SentBy != "" {
+		return k.Method + " " + k.Branch + "@" + k.SentBy
+	}
+	return k.Method + " " + k.Branch
+}
+
+// ClientKey returns the key of the client transaction that msg, a request or
+// a response to it, belongs to. The method is taken from the CSeq of
+// responses, so that a response to a CANCEL does not match the INVITE.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.3
+func ClientKey(msg sip.Message) (Key, error) {
+	vias, ok := msg.Via()
+	if !ok {
+		return Key{}, ErrNoVia
+	}
+
+	method := msg.Method()
+	if sip.IsResponse(msg) {
+		cseq, ok := msg.CSeq()
+		if !ok {
+			return Key{}, ErrNoCSeq
+		}
+		method = cseq.Method
+	}
+
+	return Key{Branch: vias[0].Branch, Method: method}, nil
+}
+
+// ServerKey returns the key of the server transaction that req belongs to. An
+// ACK belongs to the INVITE transaction it acknowledges.
+//
+// Requests whose branch lacks the magic cookie are matched on the
+// Request-URI, the From and To tags, the Call-ID, the CSeq and the top Via.
+// The To tag is left out for INVITE transactions, since the ACK carries the
+// tag of the response while the INVITE may have none.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.3
+func ServerKey(req sip.Message) (Key, error) {
+	method := req.Method()
+	if method == sip.MethodAck {
+		method = sip.MethodInvite
+	}
+	return serverKey(req, method)
+}
+
+// serverKey returns the key of the server transaction with the given method
+// that req matches. A CANCEL matches the INVITE transaction it cancels with
+// method INVITE.
+func serverKey(req sip.Message, method string) (Key, error) {
+	vias, ok := req.Via()
+	if !ok {
+		return Key{}, ErrNoVia
+	}
+	via := vias[0]
+
+	sentBy := strings.ToLower(via.Host)
+	if via.Port != "" {
+		sentBy = net.JoinHostPort(sentBy, via.Port)
+	}
+
+	if strings.HasPrefix(via.Branch, MagicCookie) {
+		return Key{Branch: via.Branch, SentBy: sentBy, Method: method}, nil
+	}
+
+	cseq, ok := req.CSeq()
+	if !ok {
+		return Key{}, ErrNoCSeq
+	}
+	var fromTag, toTag, callID string
+	if from, ok := req.From(); ok {
+		fromTag = from.Tag
+	}
+	if to, ok := req.To(); ok && method != sip.MethodInvite {
+		toTag = to.Tag
+	}
+	if id, ok := req.CallID(); ok {
+		callID = string(*id)
+	}
+
+	legacy := strings.Join([]string{
+		req.RequestURI().String(),
+		fromTag,
+		toTag,
+		callID,
+		strconv.FormatUint(uint64(cseq.Sequence), 10),
+		via.Transport,
+		sentBy,
+		via.Branch,
+	}, "|")
+	return Key{Method: method, Legacy: legacy}, nil
+}
@@ -0,0 +1,319 @@
+package transaction
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transport"
+)
+
+// Manager matches the messages received from a transport to transactions. It
+// sits between the Messages channel of a transport layer and the
+// application: retransmissions and responses are handled by the transactions
+// they belong to, and the application sees each new request once, as a
+// server transaction.
+//
+// Messages that match no transaction are handed to the core through
+// Unmatched. These are ACKs for 2xx responses, which belong to the dialog,
+// and stray responses, which a proxy forwards statelessly.
+type Manager struct {
+	tp   Transport
+	opts options
+
+	mu      sync.Mutex
+	clients map[Key]*ClientTransaction
+	servers map[Key]*ServerTransaction
+
+	requests  chan *ServerTransaction
+	unmatched chan sip.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewManager creates a manager that sends messages over tp. The options
+// apply to the transactions it creates.
+func NewManager(tp Transport, opts ...Option) *Manager {
+	return &Manager{
+		tp:        tp,
+		opts:      newOptions(opts),
+		clients:   map[Key]*ClientTransaction{},
+		servers:   map[Key]*ServerTransaction{},
+		requests:  make(chan *ServerTransaction, responseBufferSize),
+		unmatched: make(chan sip.Message, responseBufferSize),
+		done:      make(chan struct{}),
+	}
+}
+
+// Requests returns a channel of the server transactions created for new
+// requests. The application responds to the request through the
+// transaction.
+func (m *Manager) Requests() <-chan *ServerTransaction {
+	return m.requests
+}
+
+// Unmatched returns a channel of the received messages that match no
+// transaction.
+func (m *Manager) Unmatched() <-chan sip.Message {
+	return m.unmatched
+}
+
+// Request starts a client transaction for req and sends it. ErrTerminated is
+// returned once the manager is closed.
+func (m *Manager) Request(req sip.Message) (*ClientTransaction, error) {
+	return m.request(req, nil)
+}
+
+// request starts a client transaction for req that sends to targets, or to
+// the targets it locates if targets is nil.
+func (m *Manager) request(req sip.Message, targets []transport.Target) (*ClientTransaction, error) {
+	if m.closed() {
+		return nil, ErrTerminated
+	}
+
+	tx, err := prepareClientTransaction(m.tp, req, m.opts)
+	if err != nil {
+		return nil, err
+	}
+	tx.targets = targets
+	tx.rekey = m.rekey
+	key := tx.Key()
+
+	// The transaction is registered before the request is sent so that
+	// no response can miss it.
+	m.mu.Lock()
+	m.clients[key] = tx
+	m.mu.Unlock()
+	go m.forget(key, tx.Done())
+
+	if err := tx.start(); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// CancelTransaction cancels the INVITE of tx by sending a CANCEL in a client
+// transaction of its own, to the target the INVITE was sent to. If no
+// provisional response has arrived yet the CANCEL is sent once one does.
+// ErrNotPending is returned if a final response has arrived, and ErrMethod if
+// tx is not an INVITE transaction.
+//
+// The transaction user keeps reading the responses of tx, which will end with
+// 487 Request Terminated unless the CANCEL loses the race with another final
+// response.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-9.1
+func (m *Manager) CancelTransaction(tx *ClientTransaction) error {
+	if !tx.invite {
+		return ErrMethod
+	}
+
+	tx.mu.Lock()
+	switch tx.state {
+	case StateCalling:
+		tx.canceled = true
+		tx.cancel = func() {
+			tx.mu.Lock()
+			cancel, target := tx.buildCancel(), tx.target()
+			tx.mu.Unlock()
+			_, _ = m.request(cancel, target)
+		}
+		tx.mu.Unlock()
+		return nil
+	case StateProceeding:
+		tx.canceled = true
+		cancel, target := tx.buildCancel(), tx.target()
+		tx.mu.Unlock()
+		_, err := m.request(cancel, target)
+		return err
+	}
+	tx.mu.Unlock()
+	return ErrNotPending
+}
+
+// Serve hands the messages received on msgs to Handle until msgs is closed or
+// ctx is done.
+func (m *Manager) Serve(ctx context.Context, msgs <-chan *transport.Message) error {
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			m.Handle(msg)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Handle matches a received message to a transaction. A request that matches
+// none creates a server transaction, unless it is an ACK. An ACK for a 2xx
+// response goes to Unmatched even if its branch lacks the magic cookie and
+// it matches the INVITE transaction. Handle blocks while the Requests or
+// Unmatched channel is full.
+//
+// A CANCEL is answered by the manager: with 200 OK if it matches an INVITE
+// server transaction, which is answered with 487 Request Terminated if it is
+// still pending, and with 481 Call/Transaction Does Not Exist otherwise.
+func (m *Manager) Handle(msg sip.Message) {
+	if m.closed() {
+		return
+	}
+	if sip.IsResponse(msg) {
+		m.handleResponse(msg)
+		return
+	}
+
+	key, err := ServerKey(msg)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	tx, ok := m.servers[key]
+	if !ok && msg.Method() != sip.MethodAck {
+		tx, err = newServerTransaction(m.tp, msg, m.opts)
+		if err != nil {
+			m.mu.Unlock()
+			return
+		}
+		m.servers[key] = tx
+		go m.forget(key, tx.Done())
+	}
+	m.mu.Unlock()
+
+	if !ok && msg.Method() == sip.MethodCancel {
+		m.handleCancel(tx)
+		return
+	}
+
+	switch {
+	case tx == nil:
+		m.emit(msg)
+	case ok && msg.Method() == sip.MethodAck && !tx.acknowledges(msg):
+		m.emit(msg)
+	case ok:
+		tx.Receive(msg)
+	default:
+		select {
+		case m.requests <- tx:
+		case <-m.done:
+			tx.Terminate()
+		}
+	}
+}
+
+// handleCancel answers the CANCEL of the new server transaction tx.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-9.2
+func (m *Manager) handleCancel(tx *ServerTransaction) {
+	key, err := serverKey(tx.Request(), sip.MethodInvite)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	invite, ok := m.servers[key]
+	m.mu.Unlock()
+
+	if !ok {
+		_ = tx.Respond(sip.NewResponse(tx.Request(), sip.StatusCallTransactionDoesNotExist, ""))
+		return
+	}
+	invite.cancel()
+
+	// The 200 has the To tag of the responses to the INVITE.
+	res := sip.NewResponse(tx.Request(), sip.StatusOK, "")
+	if to, ok := res.To(); ok && to.Tag == "" {
+		to.Tag = invite.toTag()
+	}
+	_ = tx.Respond(res)
+}
+
+func (m *Manager) handleResponse(res sip.Message) {
+	key, err := ClientKey(res)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	tx, ok := m.clients[key]
+	m.mu.Unlock()
+
+	if ok {
+		tx.Receive(res)
+		return
+	}
+	m.emit(res)
+}
+
+// emit hands msg to the core.
+func (m *Manager) emit(msg sip.Message) {
+	select {
+	case m.unmatched <- msg:
+	case <-m.done:
+	}
+}
+
+// rekey moves a client transaction that sent its request to the next target
+// to its new key.
+func (m *Manager) rekey(from, to Key) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.clients[from]
+	if !ok {
+		return
+	}
+	delete(m.clients, from)
+	m.clients[to] = tx
+	go m.forget(to, tx.Done())
+}
+
+// forget removes a transaction once it has terminated.
+func (m *Manager) forget(key Key, done <-chan struct{}) {
+	<-done
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tx, ok := m.clients[key]; ok && tx.Done() == done {
+		delete(m.clients, key)
+	}
+	if tx, ok := m.servers[key]; ok && tx.Done() == done {
+		delete(m.servers, key)
+	}
+}
+
+func (m *Manager) closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close terminates all transactions. Messages handled afterwards are dropped.
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+
+	m.mu.Lock()
+	var clients []*ClientTransaction
+	for _, tx := range m.clients {
+		clients = append(clients, tx)
+	}
+	var servers []*ServerTransaction
+	for _, tx := range m.servers {
+		servers = append(servers, tx)
+	}
+	m.mu.Unlock()
+
+	for _, tx := range clients {
+		tx.Terminate()
+	}
+	for _, tx := range servers {
+		tx.Terminate()
+	}
+}
@@ -0,0 +1,343 @@
+package transaction
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientKey(t *testing.T) {
+	invite := testRequest(t, sip.MethodInvite)
+	reqKey, err := ClientKey(invite)
+	assert.Nil(t, err)
+	assert.Equal(t, Key{Branch: "z9hG4bK776asdhds", Method: sip.MethodInvite}, reqKey)
+
+	resKey, err := ClientKey(testResponse(t, invite, sip.StatusOK))
+	assert.Nil(t, err)
+	assert.Equal(t, reqKey, resKey)
+
+	// A response to a CANCEL has the same branch but does not belong to
+	// the INVITE transaction.
+	cancelKey, err := ClientKey(testResponse(t, testRequest(t, sip.MethodCancel), sip.StatusOK))
+	assert.Nil(t, err)
+	assert.NotEqual(t, reqKey, cancelKey)
+}
+
+func TestServerKey(t *testing.T) {
+	invite, err := ServerKey(testRequest(t, sip.MethodInvite))
+	assert.Nil(t, err)
+	assert.Equal(t, Key{Branch: "z9hG4bK776asdhds", SentBy: "pc33.atlanta.com", Method: sip.MethodInvite}, invite)
+
+	ack, err := ServerKey(testRequest(t, sip.MethodAck))
+	assert.Nil(t, err)
+	assert.Equal(t, invite, ack)
+
+	// The same branch from another sender is another transaction.
+	req := testRequest(t, sip.MethodInvite)
+	vias, _ := req.Via()
+	vias[0].Host = "pc34.atlanta.com"
+	other, err := ServerKey(req)
+	assert.Nil(t, err)
+	assert.NotEqual(t, invite, other)
+}
+
+func TestServerKeyRFC2543(t *testing.T) {
+	parse := func(method, to string) sip.Message {
+		req, err := sip.Parse([]byte(method + " sip:bob@biloxi.com SIP/2.0\r\n" +
+			"Via: SIP/2.0/UDP pc33.atlanta.com\r\n" +
+			"To: <sip:bob@biloxi.com>" + to + "\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: 1 " + method + "\r\n\r\n"))
+		assert.Nil(t, err)
+		return req
+	}
+
+	invite, err := ServerKey(parse(sip.MethodInvite, ""))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, invite.Legacy)
+
+	ack, err := ServerKey(parse(sip.MethodAck, ";tag=a6c85cf"))
+	assert.Nil(t, err)
+	assert.Equal(t, invite, ack)
+
+	bye, err := ServerKey(parse(sip.MethodBye, ";tag=a6c85cf"))
+	assert.Nil(t, err)
+	other, err := ServerKey(parse(sip.MethodBye, ";tag=314159"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, bye, other)
+}
+
+func TestManagerAbsorbsRetransmittedRequests(t *testing.T) {
+	tp := &fakeTransport{}
+	clock := newClock()
+	m := NewManager(tp, WithClock(clock))
+	defer m.Close()
+
+	m.Handle(testRequest(t, sip.MethodRegister))
+	m.Handle(testRequest(t, sip.MethodRegister))
+
+	tx := <-m.Requests()
+	assert.Equal(t, sip.MethodRegister, tx.Request().Method())
+	select {
+	case <-m.Requests():
+		t.Fatal("retransmission created a transaction")
+	default:
+	}
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+	m.Handle(testRequest(t, sip.MethodRegister))
+	assert.Equal(t, []int{sip.StatusOK, sip.StatusOK}, codes(tp.Sent()))
+
+	// Once Timer J has fired the transaction is forgotten.
+	clock.Advance(64 * T1)
+	assert.True(t, isDone(tx.Done()))
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.servers) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestManagerMatchesAck(t *testing.T) {
+	tp := &fakeTransport{}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	m.Handle(testRequest(t, sip.MethodInvite))
+	tx := <-m.Requests()
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusBusyHere)))
+
+	m.Handle(testRequest(t, sip.MethodAck))
+	assert.Equal(t, StateConfirmed, tx.State())
+
+	// An ACK for a 2xx has its own branch and goes to the core.
+	ack := testRequest(t, sip.MethodAck)
+	vias, _ := ack.Via()
+	vias[0].Branch = NewBranch()
+	m.Handle(ack)
+	assert.Equal(t, ack, <-m.Unmatched())
+}
+
+func TestManagerPassesOnLegacyAckFor2xx(t *testing.T) {
+	parse := func(method, seq string) sip.Message {
+		req, err := sip.Parse([]byte(method + " sip:bob@biloxi.com SIP/2.0\r\n" +
+			"Via: SIP/2.0/UDP pc33.atlanta.com\r\n" +
+			"To: <sip:bob@biloxi.com>;tag=a6c85cf\r\n" +
+			"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+			"Call-ID: a84b4c76e66710\r\n" +
+			"CSeq: " + seq + " " + method + "\r\n\r\n"))
+		assert.Nil(t, err)
+		return req
+	}
+
+	tp := &fakeTransport{}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	// An RFC 2543 ACK for a 2xx has the key of the INVITE transaction but
+	// belongs to the dialog.
+	m.Handle(parse(sip.MethodInvite, "1"))
+	tx := <-m.Requests()
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+
+	ack := parse(sip.MethodAck, "1")
+	m.Handle(ack)
+	assert.Equal(t, ack, <-m.Unmatched())
+	assert.Equal(t, StateAccepted, tx.State())
+
+	// An RFC 2543 ACK for a 300-699 response is absorbed.
+	m.Handle(parse(sip.MethodInvite, "2"))
+	tx = <-m.Requests()
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusBusyHere)))
+	m.Handle(parse(sip.MethodAck, "2"))
+	assert.Equal(t, StateConfirmed, tx.State())
+}
+
+func TestManagerMatchesResponses(t *testing.T) {
+	tp := &fakeTransport{transport: "udp"}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	tx, err := m.Request(testRequest(t, sip.MethodOptions))
+	assert.Nil(t, err)
+
+	m.Handle(testResponse(t, tx.Request(), sip.StatusOK))
+	assert.Equal(t, sip.StatusOK, (<-tx.Responses()).StatusCode())
+
+	stray := testResponse(t, testRequest(t, sip.MethodInvite), sip.StatusOK)
+	m.Handle(stray)
+	assert.Equal(t, stray, <-m.Unmatched())
+}
+
+func TestManagerServe(t *testing.T) {
+	m := NewManager(&fakeTransport{}, WithClock(newClock()))
+	defer m.Close()
+
+	msgs := make(chan *transport.Message, 1)
+	msgs <- &transport.Message{Message: testRequest(t, sip.MethodOptions), Transport: "udp"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- m.Serve(ctx, msgs) }()
+
+	tx := <-m.Requests()
+	msg, ok := tx.Request().(*transport.Message)
+	assert.True(t, ok)
+	assert.Equal(t, "udp", msg.Transport)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+}
+
+func TestManagerCancelTransaction(t *testing.T) {
+	tp := &fakeTransport{transport: "udp"}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	tx, err := m.Request(testRequest(t, sip.MethodInvite))
+	assert.Nil(t, err)
+
+	// The CANCEL waits for a provisional response.
+	assert.Nil(t, m.CancelTransaction(tx))
+	assert.Len(t, tp.Sent(), 1)
+
+	m.Handle(testResponse(t, tx.Request(), sip.StatusRinging))
+	assert.Eventually(t, func() bool { return len(tp.Sent()) == 2 }, time.Second, time.Millisecond)
+
+	cancel := tp.Sent()[1]
+	assert.Equal(t, sip.MethodCancel, cancel.Method())
+	assert.Equal(t, tx.Request().RequestURI(), cancel.RequestURI())
+	reqVias, _ := tx.Request().Via()
+	cancelVias, _ := cancel.Via()
+	assert.Equal(t, reqVias[0].Branch, cancelVias[0].Branch)
+	cseq, _ := cancel.CSeq()
+	assert.Equal(t, sip.CSeq{Sequence: 314159, Method: sip.MethodCancel}, *cseq)
+	to, _ := cancel.To()
+	assert.Empty(t, to.Tag)
+
+	// The response to the CANCEL is matched to its own transaction.
+	m.Handle(testResponse(t, cancel, sip.StatusOK))
+	m.Handle(testResponse(t, tx.Request(), sip.StatusRequestTerminated))
+	assert.Equal(t, sip.StatusRinging, (<-tx.Responses()).StatusCode())
+	assert.Equal(t, sip.StatusRequestTerminated, (<-tx.Responses()).StatusCode())
+	select {
+	case msg := <-m.Unmatched():
+		t.Fatalf("unexpected unmatched %d", msg.StatusCode())
+	default:
+	}
+
+	assert.Equal(t, ErrNotPending, m.CancelTransaction(tx))
+}
+
+func TestManagerCancelTransactionSendsToInviteTarget(t *testing.T) {
+	tp := &locatingTransport{
+		fakeTransport: fakeTransport{transport: "udp"},
+		targets: []transport.Target{
+			{Transport: "udp", IP: net.IPv4(192, 0, 2, 1), Port: 5060},
+			{Transport: "udp", IP: net.IPv4(192, 0, 2, 2), Port: 5070},
+		},
+	}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	tx, err := m.Request(testRequest(t, sip.MethodInvite))
+	assert.Nil(t, err)
+	m.Handle(testResponse(t, tx.Request(), sip.StatusRinging))
+
+	// A new lookup would return the targets in another order.
+	tp.mu.Lock()
+	tp.targets[0], tp.targets[1] = tp.targets[1], tp.targets[0]
+	tp.mu.Unlock()
+
+	assert.Nil(t, m.CancelTransaction(tx))
+	sentTo := tp.SentTo()
+	assert.Len(t, sentTo, 2)
+	assert.Equal(t, sip.MethodCancel, tp.Sent()[1].Method())
+	assert.Equal(t, 5060, sentTo[1].Port)
+	assert.Equal(t, 1, tp.located)
+}
+
+func TestManagerFailsOverOnServiceUnavailable(t *testing.T) {
+	tp := &locatingTransport{
+		fakeTransport: fakeTransport{transport: "udp"},
+		targets: []transport.Target{
+			{Transport: "udp", IP: net.IPv4(192, 0, 2, 1), Port: 5060},
+			{Transport: "udp", IP: net.IPv4(192, 0, 2, 2), Port: 5070},
+		},
+	}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	tx, err := m.Request(testRequest(t, sip.MethodInvite))
+	assert.Nil(t, err)
+	first := tx.Key()
+
+	// The 503 is acknowledged and the INVITE is sent to the next target in
+	// a new transaction.
+	m.Handle(testResponse(t, tx.Request(), sip.StatusServiceUnavailable))
+	sent, sentTo := tp.Sent(), tp.SentTo()
+	assert.Len(t, sent, 3)
+	assert.Equal(t, sip.MethodAck, sent[1].Method())
+	assert.Equal(t, 5060, sentTo[1].Port)
+	assert.Equal(t, sip.MethodInvite, sent[2].Method())
+	assert.Equal(t, 5070, sentTo[2].Port)
+	assert.NotEqual(t, first, tx.Key())
+	assert.Equal(t, StateCalling, tx.State())
+
+	// Responses are matched under the new key, and the last target's 503 is
+	// passed on.
+	m.Handle(testResponse(t, tx.Request(), sip.StatusServiceUnavailable))
+	assert.Equal(t, sip.StatusServiceUnavailable, (<-tx.Responses()).StatusCode())
+	assert.Equal(t, StateCompleted, tx.State())
+	assert.Len(t, tp.Sent(), 4)
+	assert.Equal(t, 1, tp.located)
+}
+
+func TestManagerAnswersCancel(t *testing.T) {
+	tp := &fakeTransport{}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	m.Handle(testRequest(t, sip.MethodInvite))
+	tx := <-m.Requests()
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusRinging)))
+
+	m.Handle(testRequest(t, sip.MethodCancel))
+	select {
+	case <-tx.Canceled():
+	case <-time.After(time.Second):
+		t.Fatal("transaction was not canceled")
+	}
+	assert.Equal(t, StateCompleted, tx.State())
+
+	sent := tp.Sent()
+	assert.Equal(t, []int{sip.StatusRinging, sip.StatusRequestTerminated, sip.StatusOK}, codes(sent))
+	cseq, _ := sent[2].CSeq()
+	assert.Equal(t, sip.MethodCancel, cseq.Method)
+	for _, res := range sent {
+		to, _ := res.To()
+		assert.Equal(t, "a6c85cf", to.Tag)
+	}
+
+	// The CANCEL is not passed on to the application.
+	select {
+	case <-m.Requests():
+		t.Fatal("CANCEL created a request")
+	default:
+	}
+}
+
+func TestManagerAnswersUnknownCancel(t *testing.T) {
+	tp := &fakeTransport{}
+	m := NewManager(tp, WithClock(newClock()))
+	defer m.Close()
+
+	m.Handle(testRequest(t, sip.MethodCancel))
+	assert.Equal(t, []int{sip.StatusCallTransactionDoesNotExist}, codes(tp.Sent()))
+}
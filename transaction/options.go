@@ -0,0 +1,104 @@
+package transaction
+
+import (
+	"time"
+
+	"github.com/nilssonr/sip/clock"
+)
+
+// Clock schedules the timers of transactions. It defaults to clock.Real, and
+// clock.Fake lets tests run the timers without sleeping.
+type Clock = clock.Clock
+
+// Timer is a timer scheduled with Clock.AfterFunc.
+type Timer = clock.Timer
+
+// Timers overrides the timer values of transactions. Fields that are zero
+// keep their default. T1 should be raised on links with a high round-trip
+// time, such as satellite links.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#appendix-A
+type Timers struct {
+	T1 time.Duration
+	T2 time.Duration
+	T4 time.Duration
+	// B, F and H are the timeouts of INVITE client, non-INVITE client and
+	// INVITE server transactions. They default to 64*T1.
+	B time.Duration
+	F time.Duration
+	H time.Duration
+}
+
+// Option configures a transaction or a manager.
+type Option func(*options)
+
+// options holds the clock and timer values of a transaction. Timer D is not
+// derived from T1 since it has to cover the retransmissions of a server that
+// may use the default T1. trying is how long an INVITE server transaction
+// waits for the transaction user to respond before it sends 100 Trying
+// itself.
+type options struct {
+	clock      Clock
+	t1, t2, t4 time.Duration
+	b, f, h    time.Duration
+	d          time.Duration
+	trying     time.Duration
+	events     func(Event)
+}
+
+func defaultOptions() options {
+	return options{
+		clock:  clock.Real(),
+		t1:     T1,
+		t2:     T2,
+		t4:     T4,
+		d:      32 * time.Second,
+		trying: 200 * time.Millisecond,
+	}
+}
+
+// newOptions applies opts to the defaults and derives the timeouts that have
+// not been set from T1.
+func newOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for _, d := range []*time.Duration{&o.b, &o.f, &o.h} {
+		if *d == 0 {
+			*d = 64 * o.t1
+		}
+	}
+	return o
+}
+
+// WithClock sets the clock that schedules the timers.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithTimers overrides the default timer values.
+func WithTimers(t Timers) Option {
+	return func(o *options) {
+		if t.T1 > 0 {
+			o.t1 = t.T1
+		}
+		if t.T2 > 0 {
+			o.t2 = t.T2
+		}
+		if t.T4 > 0 {
+			o.t4 = t.T4
+		}
+		if t.B > 0 {
+			o.b = t.B
+		}
+		if t.F > 0 {
+			o.f = t.F
+		}
+		if t.H > 0 {
+			o.h = t.H
+		}
+	}
+}
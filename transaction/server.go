@@ -0,0 +1,437 @@
+package transaction
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// ServerTransaction is a server transaction. It sends the responses of the
+// transaction user, absorbs retransmissions of the request by resending the
+// last response, and retransmits final responses to an INVITE over
+// unreliable transports until they are acknowledged. The transaction user
+// therefore sees each request only once.
+//
+// Retransmissions of the request and ACKs that match the transaction have to
+// be handed to it with Receive.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2
+type ServerTransaction struct {
+	mu       sync.Mutex
+	tp       Transport
+	req      sip.Message
+	last     sip.Message
+	invite   bool
+	opts     options
+	obs      observer
+	reliable bool
+	state    State
+	err      error
+	interval time.Duration
+	done     chan struct{}
+	canceled chan struct{}
+
+	// trying sends 100 Trying, retransmit is Timer G, timeout is Timer H and
+	// linger is Timer I or J or, in the Accepted state, Timer L.
+	trying     Timer
+	retransmit Timer
+	timeout    Timer
+	linger     Timer
+}
+
+// NewServerTransaction starts a server transaction for req, which has been
+// received from tp. An INVITE transaction sends 100 Trying if the
+// transaction user does not respond within 200 ms.
+//
+// ACK requests do not start a transaction and are rejected with ErrMethod.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.1
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.2
+func NewServerTransaction(tp Transport, req sip.Message, opts ...Option) (*ServerTransaction, error) {
+	return newServerTransaction(tp, req, newOptions(opts))
+}
+
+func newServerTransaction(tp Transport, req sip.Message, o options) (*ServerTransaction, error) {
+	if req.Method() == sip.MethodAck {
+		return nil, ErrMethod
+	}
+	vias, ok := req.Via()
+	if !ok {
+		return nil, ErrNoVia
+	}
+	key, err := ServerKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &ServerTransaction{
+		tp:       tp,
+		req:      req,
+		invite:   req.Method() == sip.MethodInvite,
+		opts:     o,
+		reliable: isReliable(vias[0].Transport),
+		state:    StateTrying,
+		done:     make(chan struct{}),
+		canceled: make(chan struct{}),
+		obs:      newObserver(o, key, req.Method(), true),
+	}
+	if tx.invite {
+		tx.state = StateProceeding
+	}
+	tx.obs.emit(Event{Kind: EventCreated, State: tx.state, From: tx.state})
+	if tx.invite {
+		tx.trying = tx.opts.clock.AfterFunc(o.trying, tx.fireTrying)
+	}
+
+	return tx, nil
+}
+
+// Key returns the key of the transaction.
+func (tx *ServerTransaction) Key() Key {
+	return tx.obs.key
+}
+
+// Request returns the request of the transaction.
+func (tx *ServerTransaction) Request() sip.Message {
+	return tx.req
+}
+
+// Done returns a channel that is closed when the transaction terminates.
+func (tx *ServerTransaction) Done() <-chan struct{} {
+	return tx.done
+}
+
+// Canceled returns a channel that is closed when the request is canceled by
+// a CANCEL. The transaction has responded with 487 Request Terminated by
+// then.
+func (tx *ServerTransaction) Canceled() <-chan struct{} {
+	return tx.canceled
+}
+
+// Err returns why the transaction terminated: ErrTimeout if a final response
+// was not acknowledged in time, ErrTerminated if Terminate was called, the
+// error of the transport if a response could not be sent, and nil otherwise.
+func (tx *ServerTransaction) Err() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.err
+}
+
+// State returns the state of the transaction.
+func (tx *ServerTransaction) State() State {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.state
+}
+
+// Terminate terminates the transaction without waiting for its timers.
+func (tx *ServerTransaction) Terminate() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.terminate(ErrTerminated)
+}
+
+// Respond sends a response of the transaction user. Once a final response
+// has been sent ErrResponded is returned, except that a 2xx response to an
+// INVITE moves the transaction to Accepted, in which the transaction user
+// retransmits it through Respond until the ACK arrives.
+func (tx *ServerTransaction) Respond(res sip.Message) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.invite {
+		return tx.respondInvite(res)
+	}
+	return tx.respond(res)
+}
+
+// respondInvite sends a response to an INVITE.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.1
+// See: https://datatracker.ietf.org/doc/html/rfc6026#section-7.1
+func (tx *ServerTransaction) respondInvite(res sip.Message) error {
+	code := res.StatusCode()
+	switch tx.state {
+	case StateProceeding:
+	case StateAccepted:
+		if code < 200 || code >= 300 {
+			return ErrResponded
+		}
+		return tx.retransmit2xx(res)
+	case StateTerminated:
+		return ErrTerminated
+	default:
+		return ErrResponded
+	}
+
+	stopTimers(tx.trying)
+	if err := tx.send(res); err != nil {
+		return err
+	}
+	tx.last = res
+
+	switch {
+	case code < 200:
+	case code < 300:
+		tx.setState(StateAccepted)
+		tx.linger = tx.opts.clock.AfterFunc(64*tx.opts.t1, tx.fireLinger)
+	default:
+		tx.setState(StateCompleted)
+		if !tx.reliable {
+			tx.interval = tx.opts.t1
+			tx.retransmit = tx.opts.clock.AfterFunc(tx.interval, tx.fireRetransmit)
+		}
+		tx.timeout = tx.opts.clock.AfterFunc(tx.opts.h, tx.fireTimeout)
+	}
+	return nil
+}
+
+// respond sends a response to a non-INVITE request.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.2
+func (tx *ServerTransaction) respond(res sip.Message) error {
+	switch tx.state {
+	case StateTrying, StateProceeding:
+	case StateTerminated:
+		return ErrTerminated
+	default:
+		return ErrResponded
+	}
+
+	if err := tx.send(res); err != nil {
+		return err
+	}
+	tx.last = res
+
+	if res.StatusCode() < 200 {
+		tx.setState(StateProceeding)
+		return nil
+	}
+	tx.setState(StateCompleted)
+	if tx.reliable {
+		tx.terminate(nil)
+		return nil
+	}
+	tx.linger = tx.opts.clock.AfterFunc(64*tx.opts.t1, tx.fireLinger)
+	return nil
+}
+
+// Receive hands a request that matches the transaction to it. A
+// retransmission of the request is answered with the last provisional
+// response in Proceeding and with the final response in Completed, and is
+// absorbed otherwise. An ACK to the final response to an INVITE moves the
+// transaction to Confirmed.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.1
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.2
+func (tx *ServerTransaction) Receive(req sip.Message) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if req.Method() == sip.MethodAck {
+		if !tx.invite {
+			return
+		}
+		if tx.state != StateCompleted {
+			return
+		}
+		stopTimers(tx.retransmit, tx.timeout)
+		tx.setState(StateConfirmed)
+		if tx.reliable {
+			tx.terminate(nil)
+			return
+		}
+		tx.linger = tx.opts.clock.AfterFunc(tx.opts.t4, tx.fireLinger)
+		return
+	}
+
+	switch tx.state {
+	case StateProceeding, StateCompleted:
+		if tx.last != nil {
+			tx.resend()
+		}
+	}
+}
+
+// cancel responds to a pending INVITE with 487 Request Terminated, using the
+// To tag of the last provisional response if there is one. It reports
+// whether the request was canceled.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-9.2
+func (tx *ServerTransaction) cancel() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if !tx.invite || tx.state != StateProceeding {
+		return false
+	}
+
+	res := sip.NewResponse(tx.req, sip.StatusRequestTerminated, "")
+	if to, ok := res.To(); ok && to.Tag == "" {
+		to.Tag = newTag()
+		if tx.last != nil {
+			if last, ok := tx.last.To(); ok && last.Tag != "" {
+				to.Tag = last.Tag
+			}
+		}
+	}
+	if err := tx.respondInvite(res); err != nil {
+		return false
+	}
+	close(tx.canceled)
+	return true
+}
+
+// acknowledges reports whether ack, an ACK with the key of the transaction,
+// acknowledges a 300-699 response sent by it. An ACK for a 2xx response
+// belongs to the dialog, but has the key of the INVITE transaction when its
+// branch lacks the magic cookie. Such an ACK must also carry the To tag of
+// the response it acknowledges.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.3
+func (tx *ServerTransaction) acknowledges(ack sip.Message) bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.state != StateCompleted && tx.state != StateConfirmed {
+		return false
+	}
+	vias, _ := ack.Via()
+	if strings.HasPrefix(vias[0].Branch, MagicCookie) {
+		return true
+	}
+	to, ok := ack.To()
+	last, _ := tx.last.To()
+	return ok && last != nil && to.Tag == last.Tag
+}
+
+// toTag returns the To tag of the last response sent, if any.
+func (tx *ServerTransaction) toTag() string {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.last == nil {
+		return ""
+	}
+	if to, ok := tx.last.To(); ok {
+		return to.Tag
+	}
+	return ""
+}
+
+// fireTrying sends 100 Trying if the transaction user has not responded.
+func (tx *ServerTransaction) fireTrying() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.state != StateProceeding || tx.last != nil {
+		return
+	}
+	res := sip.NewResponse(tx.req, sip.StatusTrying, "")
+	if err := tx.send(res); err == nil {
+		tx.last = res
+	}
+}
+
+// fireRetransmit retransmits the final response and doubles the interval up
+// to T2.
+func (tx *ServerTransaction) fireRetransmit() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.state != StateCompleted {
+		return
+	}
+	if !tx.resend() {
+		return
+	}
+	tx.interval *= 2
+	if tx.interval > tx.opts.t2 {
+		tx.interval = tx.opts.t2
+	}
+	tx.retransmit = tx.opts.clock.AfterFunc(tx.interval, tx.fireRetransmit)
+}
+
+// fireTimeout gives up on the ACK to the final response.
+func (tx *ServerTransaction) fireTimeout() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.state != StateCompleted {
+		return
+	}
+	tx.obs.emit(Event{Kind: EventTimeout, State: tx.state, From: tx.state, Err: ErrTimeout})
+	tx.terminate(ErrTimeout)
+}
+
+func (tx *ServerTransaction) fireLinger() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	switch tx.state {
+	case StateCompleted:
+		if tx.invite {
+			return
+		}
+	case StateConfirmed, StateAccepted:
+	default:
+		return
+	}
+	tx.terminate(nil)
+}
+
+// send sends res over the transport, terminating the transaction if it
+// fails.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.2.4
+func (tx *ServerTransaction) send(res sip.Message) error {
+	if err := tx.tp.Send(res); err != nil {
+		tx.obs.emit(Event{Kind: EventTransportError, State: tx.state, From: tx.state, Message: res, Err: err})
+		tx.terminate(err)
+		return err
+	}
+	return nil
+}
+
+// resend sends the last response again and reports whether it was sent.
+func (tx *ServerTransaction) resend() bool {
+	if err := tx.send(tx.last); err != nil {
+		return false
+	}
+	tx.obs.emit(Event{Kind: EventRetransmitted, State: tx.state, From: tx.state, Message: tx.last})
+	return true
+}
+
+// retransmit2xx sends a retransmission of a 2xx response by the transaction
+// user.
+func (tx *ServerTransaction) retransmit2xx(res sip.Message) error {
+	if err := tx.send(res); err != nil {
+		return err
+	}
+	tx.obs.emit(Event{Kind: EventRetransmitted, State: tx.state, From: tx.state, Message: res})
+	return nil
+}
+
+func (tx *ServerTransaction) setState(state State) {
+	from := tx.state
+	tx.state = state
+	tx.obs.emit(Event{Kind: EventStateChanged, State: state, From: from})
+}
+
+// terminate moves the transaction to Terminated. It must be called with tx.mu
+// held.
+func (tx *ServerTransaction) terminate(err error) {
+	if tx.state == StateTerminated {
+		return
+	}
+	stopTimers(tx.trying, tx.retransmit, tx.timeout, tx.linger)
+	tx.err = err
+	tx.setState(StateTerminated)
+	close(tx.done)
+	tx.obs.emit(Event{Kind: EventTerminated, State: StateTerminated, From: StateTerminated, Err: err})
+}
@@ -0,0 +1,163 @@
+package transaction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+func codes(msgs []sip.Message) []int {
+	var codes []int
+	for _, msg := range msgs {
+		codes = append(codes, msg.StatusCode())
+	}
+	return codes
+}
+
+func TestServerTransactionSendsTrying(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{}
+	tx, err := NewServerTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+	defer tx.Terminate()
+
+	// A retransmission before any response is absorbed.
+	tx.Receive(tx.Request())
+	assert.Len(t, tp.Sent(), 0)
+
+	clock.Advance(200 * time.Millisecond)
+	assert.Equal(t, []int{sip.StatusTrying}, codes(tp.Sent()))
+
+	tx.Receive(tx.Request())
+	assert.Equal(t, []int{sip.StatusTrying, sip.StatusTrying}, codes(tp.Sent()))
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusRinging)))
+	tx.Receive(tx.Request())
+	assert.Equal(t, []int{100, 100, 180, 180}, codes(tp.Sent()))
+}
+
+func TestServerTransactionSkipsTryingAfterResponse(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{}
+	tx, err := NewServerTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+	defer tx.Terminate()
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusRinging)))
+	clock.Advance(time.Second)
+	assert.Equal(t, []int{sip.StatusRinging}, codes(tp.Sent()))
+}
+
+func TestServerTransactionRetransmitsFailure(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{}
+	tx, err := NewServerTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusBusyHere)))
+	assert.Equal(t, StateCompleted, tx.State())
+	assert.Equal(t, ErrResponded, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+
+	// Timer G fires after 0.5, 1.5, 3.5, 7.5 and 11.5 s.
+	clock.Advance(11500 * time.Millisecond)
+	assert.Len(t, tp.Sent(), 6)
+
+	tx.Receive(testRequest(t, sip.MethodAck))
+	assert.Equal(t, StateConfirmed, tx.State())
+
+	// Timer I.
+	clock.Advance(T4 - time.Millisecond)
+	assert.Len(t, tp.Sent(), 6)
+	assert.False(t, isDone(tx.Done()))
+	clock.Advance(time.Millisecond)
+	assert.True(t, isDone(tx.Done()))
+	assert.Nil(t, tx.Err())
+}
+
+func TestServerTransactionTimeout(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{}
+	req := testRequest(t, sip.MethodInvite)
+	vias, _ := req.Via()
+	vias[0].Transport = "tcp"
+	tx, err := NewServerTransaction(tp, req, WithClock(clock), WithTimers(Timers{H: time.Second}))
+	assert.Nil(t, err)
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusNotFound)))
+
+	clock.Advance(time.Second)
+	assert.True(t, isDone(tx.Done()))
+	assert.Equal(t, ErrTimeout, tx.Err())
+	assert.Len(t, tp.Sent(), 1)
+}
+
+func TestServerTransactionAccepted(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{}
+	tx, err := NewServerTransaction(tp, testRequest(t, sip.MethodInvite), WithClock(clock))
+	assert.Nil(t, err)
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+	assert.Equal(t, StateAccepted, tx.State())
+
+	// The transaction user retransmits the 2xx and retransmissions of the
+	// request are absorbed.
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+	tx.Receive(tx.Request())
+	assert.Equal(t, []int{sip.StatusOK, sip.StatusOK}, codes(tp.Sent()))
+
+	// Timer L.
+	clock.Advance(64 * T1)
+	assert.True(t, isDone(tx.Done()))
+	assert.Nil(t, tx.Err())
+	assert.Equal(t, ErrTerminated, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+}
+
+func TestServerTransactionNonInvite(t *testing.T) {
+	clock := newClock()
+	tp := &fakeTransport{}
+	tx, err := NewServerTransaction(tp, testRequest(t, sip.MethodRegister), WithClock(clock))
+	assert.Nil(t, err)
+	assert.Equal(t, StateTrying, tx.State())
+
+	// No 100 Trying is sent, and retransmissions in Trying are absorbed.
+	clock.Advance(time.Second)
+	tx.Receive(tx.Request())
+	assert.Len(t, tp.Sent(), 0)
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusTrying)))
+	assert.Equal(t, StateProceeding, tx.State())
+	tx.Receive(tx.Request())
+
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+	assert.Equal(t, StateCompleted, tx.State())
+	assert.Equal(t, ErrResponded, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+	tx.Receive(tx.Request())
+	assert.Equal(t, []int{100, 100, 200, 200}, codes(tp.Sent()))
+
+	// Timer J.
+	clock.Advance(64 * T1)
+	assert.True(t, isDone(tx.Done()))
+	assert.Nil(t, tx.Err())
+}
+
+func TestServerTransactionNonInviteReliable(t *testing.T) {
+	tp := &fakeTransport{}
+	req := testRequest(t, sip.MethodOptions)
+	vias, _ := req.Via()
+	vias[0].Transport = "tls"
+	tx, err := NewServerTransaction(tp, req)
+	assert.Nil(t, err)
+
+	// Timer J is zero over reliable transports.
+	assert.Nil(t, tx.Respond(testResponse(t, tx.Request(), sip.StatusOK)))
+	assert.Equal(t, StateTerminated, tx.State())
+	assert.Nil(t, tx.Err())
+}
+
+func TestServerTransactionRejectsAck(t *testing.T) {
+	_, err := NewServerTransaction(&fakeTransport{}, testRequest(t, sip.MethodAck))
+	assert.Equal(t, ErrMethod, err)
+}
@@ -0,0 +1,144 @@
+// Package transaction implements the SIP transaction layer described in
+// RFC 3261 section 17: the client and server state machines that retransmit
+// requests and responses over unreliable transports and match responses to
+// the requests they answer.
+package transaction
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transport"
+)
+
+// MagicCookie starts every branch parameter generated by an RFC 3261
+// compliant element.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-8.1.1.7
+const MagicCookie = "z9hG4bK"
+
+// Default timer values.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#appendix-A
+const (
+	// T1 is the round-trip time estimate.
+	T1 = 500 * time.Millisecond
+	// T2 is the maximum retransmit interval for non-INVITE requests and
+	// INVITE responses.
+	T2 = 4 * time.Second
+	// T4 is the maximum duration a message remains in the network.
+	T4 = 5 * time.Second
+)
+
+// responseBufferSize is the number of responses buffered for the transaction
+// user. Responses that do not fit are dropped, so the transaction user must
+// keep reading until the channel is closed.
+const responseBufferSize = 64
+
+var (
+	ErrMethod     = errors.New("transaction: method cannot start a transaction")
+	ErrNoVia      = errors.New("transaction: request has no Via header")
+	ErrNoCSeq     = errors.New("transaction: request has no CSeq header")
+	ErrTimeout    = errors.New("transaction: timed out")
+	ErrTerminated = errors.New("transaction: terminated")
+	ErrResponded  = errors.New("transaction: final response already sent")
+	ErrNotPending = errors.New("transaction: final response already received")
+)
+
+// State is the state of a transaction.
+type State int
+
+const (
+	StateCalling State = iota
+	StateTrying
+	StateProceeding
+	StateCompleted
+	StateConfirmed
+	// StateAccepted is the state an INVITE transaction enters on a 2xx
+	// response, so that retransmissions of the 2xx are passed on instead of
+	// being treated as new transactions.
+	//
+	// See: https://datatracker.ietf.org/doc/html/rfc6026#section-7
+	StateAccepted
+	StateTerminated
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCalling:
+		return "Calling"
+	case StateTrying:
+		return "Trying"
+	case StateProceeding:
+		return "Proceeding"
+	case StateCompleted:
+		return "Completed"
+	case StateConfirmed:
+		return "Confirmed"
+	case StateAccepted:
+		return "Accepted"
+	case StateTerminated:
+		return "Terminated"
+	}
+	return "Unknown"
+}
+
+// Transport sends the messages of transactions. A transport.Layer satisfies
+// it. Sending a request sets the transport of its top Via, which tells the
+// transaction whether it has to retransmit.
+type Transport interface {
+	Send(msg sip.Message) error
+}
+
+// Locator is a Transport that locates the targets of a request before
+// sending it. A transport.Layer satisfies it. A client transaction over a
+// Locator locates its request once and sends the request, its
+// retransmissions and its ACK to the same target, since a second lookup may
+// order the targets differently.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-17.1.1.3
+type Locator interface {
+	Transport
+	Locate(ctx context.Context, msg sip.Message) ([]transport.Target, error)
+	SendTo(msg sip.Message, target transport.Target) error
+}
+
+// NewBranch returns a new branch parameter for a Via header field.
+func NewBranch() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return MagicCookie + hex.EncodeToString(b)
+}
+
+// newTag returns a new tag parameter for a From or To header field.
+func newTag() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// isReliable reports whether a message whose top Via has this transport is
+// sent over a reliable transport, which needs no retransmissions.
+func isReliable(transport string) bool {
+	switch transport {
+	case "tcp", "tls", "sctp", "ws", "wss":
+		return true
+	}
+	return false
+}
+
+func stopTimers(timers ...Timer) {
+	for _, t := range timers {
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
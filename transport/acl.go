@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// ACLAction is what happens to a request denied by an ACL.
+type ACLAction int
+
+const (
+	// ACLDrop discards denied messages without an answer and closes denied
+	// connections when they are accepted.
+	ACLDrop ACLAction = iota
+	// ACLReject answers denied requests with 403 Forbidden. Other denied
+	// messages are discarded.
+	ACLReject
+)
+
+// ACLRule restricts the sources of the messages a listener accepts.
+type ACLRule struct {
+	// Listener restricts the rule to the listener with this name. When it is
+	// empty the rule applies to every listener.
+	Listener string
+	// Methods restricts the rule to requests with these methods. When it is
+	// empty the rule applies to every message and to new connections.
+	Methods []string
+	// Deny lists the sources that are denied. Allow, when it is not empty,
+	// lists the only sources that are allowed.
+	Deny  []netip.Prefix
+	Allow []netip.Prefix
+}
+
+// ACL is a set of rules evaluated for every message. A message is accepted
+// when it passes every rule that applies to it.
+type ACL struct {
+	Rules  []ACLRule
+	Action ACLAction
+}
+
+// permits reports whether the rule lets ip through.
+func (r *ACLRule) permits(ip netip.Addr) bool {
+	for _, prefix := range r.Deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range r.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a message or connection from ip on listener passes
+// the rules. Method rules are skipped when method is empty, as it is for
+// connections and messages that have not been parsed.
+func (a *ACL) allows(listener, method string, ip netip.Addr) bool {
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if rule.Listener != "" && rule.Listener != listener {
+			continue
+		}
+		if len(rule.Methods) > 0 {
+			matched := false
+			for _, m := range rule.Methods {
+				if m == method {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		if !rule.permits(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetACL implements Layer. The rules apply to messages received after it
+// returns; connections that are already open are not closed.
+func (l *layer) SetACL(acl ACL) {
+	l.acl.Store(&acl)
+}
+
+// admitConn applies the ACL to a new connection or a raw message. Only ACLs
+// that drop what they deny are applied before parsing, since a 403 needs the
+// request.
+func (l *layer) admitConn(ln *Listener, addr net.Addr) bool {
+	acl := l.acl.Load()
+	if acl == nil || acl.Action != ACLDrop {
+		return true
+	}
+
+	if acl.allows(listenerName(ln), "", addrPort(addr).Addr()) {
+		return true
+	}
+	l.counters.denied.Add(1)
+	return false
+}
+
+// admitACL applies the ACL to a parsed message and answers denied requests
+// when the ACL rejects them.
+func (l *layer) admitACL(ln *Listener, addr net.Addr, msg sip.Message) bool {
+	acl := l.acl.Load()
+	if acl == nil {
+		return true
+	}
+
+	var method string
+	if sip.IsRequest(msg) {
+		method = msg.Method()
+	}
+	if acl.allows(listenerName(ln), method, addrPort(addr).Addr()) {
+		return true
+	}
+	l.counters.denied.Add(1)
+
+	if acl.Action == ACLReject && method != "" && method != sip.MethodAck {
+		if err := l.Send(sip.NewResponse(msg, sip.StatusForbidden, "")); err != nil {
+			l.reportError(ErrorKindWrite, networkName(addr.Network()), addr, err)
+		}
+	}
+	return false
+}
+
+func listenerName(ln *Listener) string {
+	if ln == nil {
+		return ""
+	}
+	return ln.Name
+}
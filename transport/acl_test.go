@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLAllows(t *testing.T) {
+	acl := ACL{Rules: []ACLRule{
+		{Deny: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}},
+		{
+			Listener: "trunk",
+			Methods:  []string{"INVITE"},
+			Allow:    []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+	}}
+
+	tests := []struct {
+		Listener string
+		Method   string
+		IP       string
+		Allowed  bool
+	}{
+		{Listener: "trunk", Method: "INVITE", IP: "192.0.2.10", Allowed: true},
+		{Listener: "trunk", Method: "INVITE", IP: "203.0.113.10", Allowed: false},
+		{Listener: "trunk", Method: "OPTIONS", IP: "203.0.113.10", Allowed: true},
+		{Listener: "trunk", Method: "", IP: "203.0.113.10", Allowed: true},
+		{Listener: "access", Method: "INVITE", IP: "203.0.113.10", Allowed: true},
+		{Listener: "access", Method: "REGISTER", IP: "198.51.100.1", Allowed: false},
+		{Listener: "trunk", Method: "", IP: "198.51.100.1", Allowed: false},
+	}
+
+	for _, test := range tests {
+		allowed := acl.allows(test.Listener, test.Method, netip.MustParseAddr(test.IP))
+		assert.Equal(t, test.Allowed, allowed, "%s %s from %s", test.Listener, test.Method, test.IP)
+	}
+}
+
+func TestACL(t *testing.T) {
+	l := NewLayer(WithQueueSize(10), WithACL(ACL{
+		Rules: []ACLRule{{
+			Listener: "trunk",
+			Methods:  []string{"INVITE"},
+			Allow:    []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		}},
+		Action: ACLReject,
+	}))
+	defer l.Shutdown(context.Background())
+
+	addr, err := l.Listen(context.Background(), "udp", "127.0.0.1:0", WithName("trunk"))
+	assert.Nil(t, err)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	request := func(method string) {
+		req := strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1", "SIP/2.0/UDP 127.0.0.1;rport", 1)
+		_, err := client.WriteTo([]byte(strings.ReplaceAll(req, "OPTIONS", method)), addr)
+		assert.Nil(t, err)
+	}
+
+	request("INVITE")
+	buf := make([]byte, maxPacketSize)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "SIP/2.0 403 Forbidden\r\n"))
+
+	request("OPTIONS")
+	msg := <-l.Messages()
+	assert.Equal(t, "OPTIONS", msg.Method())
+
+	// Replaced rules apply to the next message.
+	l.SetACL(ACL{Rules: []ACLRule{{Deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}}})
+	request("OPTIONS")
+	assert.Eventually(t, func() bool {
+		return l.Stats().Denied == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, l.Stats().QueueDepth)
+}
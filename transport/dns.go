@@ -0,0 +1,465 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal DNS client for the NAPTR, SRV, A and AAAA lookups of RFC 3263.
+// The standard library resolver cannot query NAPTR records.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc1035#section-4
+// See: https://datatracker.ietf.org/doc/html/rfc3403#section-4
+
+const (
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+	dnsTypeNAPTR = 35
+
+	dnsClassIN = 1
+
+	dnsHeaderSize = 12
+	dnsMaxSize    = 4096
+
+	dnsRcodeNameError = 3
+
+	// dnsNegativeTTL is how long an answer without records is cached, since
+	// the SOA record that holds the negative TTL is not decoded.
+	dnsNegativeTTL = 30 * time.Second
+	// maxDNSCacheEntries bounds the number of answers a DNSResolver caches.
+	maxDNSCacheEntries = 4096
+)
+
+var (
+	errInvalidDNS   = errors.New("transport: invalid DNS message")
+	errDNSFailure   = errors.New("transport: DNS server failure")
+	errDNSTruncated = errors.New("transport: truncated DNS response")
+)
+
+type dnsRecord struct {
+	name string
+	typ  uint16
+	ttl  uint32
+
+	ip net.IP
+
+	priority uint16
+	weight   uint16
+	port     uint16
+	target   string
+
+	order       uint16
+	preference  uint16
+	flags       string
+	service     string
+	regexp      string
+	replacement string
+}
+
+// encodeDNSQuery builds a recursive query for name.
+func encodeDNSQuery(id uint16, name string, typ uint16) []byte {
+	b := make([]byte, dnsHeaderSize, 512)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	binary.BigEndian.PutUint16(b[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(b[4:6], 1)
+
+	b = appendDNSName(b, name)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN)
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName reads a possibly compressed domain name at off and returns it
+// together with the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		next   = -1
+		jumps  = 0
+	)
+
+	for {
+		if off >= len(msg) {
+			return "", 0, errInvalidDNS
+		}
+
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errInvalidDNS
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3fff)
+			jumps++
+
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errInvalidDNS
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+func readCharString(msg []byte, off int) (string, int, error) {
+	if off >= len(msg) || off+1+int(msg[off]) > len(msg) {
+		return "", 0, errInvalidDNS
+	}
+	end := off + 1 + int(msg[off])
+	return string(msg[off+1 : end]), end, nil
+}
+
+// decodeDNSResponse returns the answer records of a response to the query with
+// the given id. It returns errDNSTruncated if the response did not fit in a
+// datagram.
+func decodeDNSResponse(msg []byte, id uint16) ([]dnsRecord, error) {
+	if len(msg) < dnsHeaderSize || binary.BigEndian.Uint16(msg[0:2]) != id {
+		return nil, errInvalidDNS
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 == 0 {
+		return nil, errInvalidDNS
+	}
+	if flags&0x0200 != 0 {
+		return nil, errDNSTruncated
+	}
+	switch flags & 0x000f {
+	case 0:
+	case dnsRcodeNameError:
+		return nil, nil
+	default:
+		return nil, errDNSFailure
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	off := dnsHeaderSize
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	records := make([]dnsRecord, 0, ancount)
+	for i := 0; i < ancount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errInvalidDNS
+		}
+
+		r := dnsRecord{
+			name: name,
+			typ:  binary.BigEndian.Uint16(msg[off : off+2]),
+			ttl:  binary.BigEndian.Uint32(msg[off+4 : off+8]),
+		}
+		length := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, errInvalidDNS
+		}
+		rdata := msg[off : off+length]
+
+		switch r.typ {
+		case dnsTypeA, dnsTypeAAAA:
+			r.ip = net.IP(append([]byte(nil), rdata...))
+
+		case dnsTypeSRV:
+			if length < 7 {
+				return nil, errInvalidDNS
+			}
+			r.priority = binary.BigEndian.Uint16(rdata[0:2])
+			r.weight = binary.BigEndian.Uint16(rdata[2:4])
+			r.port = binary.BigEndian.Uint16(rdata[4:6])
+			if r.target, _, err = readDNSName(msg, off+6); err != nil {
+				return nil, err
+			}
+
+		case dnsTypeNAPTR:
+			if length < 7 {
+				return nil, errInvalidDNS
+			}
+			r.order = binary.BigEndian.Uint16(rdata[0:2])
+			r.preference = binary.BigEndian.Uint16(rdata[2:4])
+			pos := off + 4
+			if r.flags, pos, err = readCharString(msg, pos); err != nil {
+				return nil, err
+			}
+			if r.service, pos, err = readCharString(msg, pos); err != nil {
+				return nil, err
+			}
+			if r.regexp, pos, err = readCharString(msg, pos); err != nil {
+				return nil, err
+			}
+			if r.replacement, _, err = readDNSName(msg, pos); err != nil {
+				return nil, err
+			}
+		}
+
+		records = append(records, r)
+		off += length
+	}
+
+	return records, nil
+}
+
+// DNSResolver locates SIP servers with NAPTR, SRV and A/AAAA queries sent to
+// a DNS server. Answers are cached for their TTL.
+type DNSResolver struct {
+	// Server is the address of the DNS server, for example "192.0.2.53:53".
+	Server string
+	// Timeout bounds every query. It defaults to five seconds.
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+	// now returns the current time. It is replaced by tests.
+	now func() time.Time
+}
+
+type dnsCacheEntry struct {
+	records []dnsRecord
+	expires time.Time
+}
+
+// NewDNSResolver creates a resolver that queries server. If server is empty
+// the first nameserver in /etc/resolv.conf is used.
+func NewDNSResolver(server string) *DNSResolver {
+	if server == "" {
+		server = systemNameserver()
+	}
+	return &DNSResolver{Server: server, Timeout: 5 * time.Second}
+}
+
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// query returns the answer records of the requested type for name, from the
+// cache or from the DNS server. A truncated response is retried over TCP.
+// Failures are not cached.
+func (r *DNSResolver) query(ctx context.Context, name string, typ uint16) ([]dnsRecord, error) {
+	key := strings.ToLower(name) + "/" + strconv.Itoa(int(typ))
+	if records, ok := r.cached(key); ok {
+		return records, nil
+	}
+
+	records, err := r.exchange(ctx, "udp", name, typ)
+	if errors.Is(err, errDNSTruncated) {
+		records, err = r.exchange(ctx, "tcp", name, typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	answers := records[:0]
+	for _, record := range records {
+		if record.typ == typ {
+			answers = append(answers, record)
+		}
+	}
+	r.store(key, answers)
+	return answers, nil
+}
+
+// exchange sends a single question to the DNS server over network and
+// returns the answer records.
+func (r *DNSResolver) exchange(ctx context.Context, network, name string, typ uint16) ([]dnsRecord, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var idb [2]byte
+	rand.Read(idb[:])
+	id := binary.BigEndian.Uint16(idb[:])
+
+	query := encodeDNSQuery(id, name, typ)
+	if network == "tcp" {
+		// Messages sent over TCP are prefixed with their length.
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		return decodeDNSResponse(buf, id)
+	}
+
+	buf := make([]byte, dnsMaxSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		records, err := decodeDNSResponse(buf[:n], id)
+		if errors.Is(err, errInvalidDNS) {
+			// Not the response to our query, keep waiting.
+			continue
+		}
+		return records, err
+	}
+}
+
+// cached returns the unexpired answer for key.
+func (r *DNSResolver) cached(key string) ([]dnsRecord, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[key]
+	if !ok || !r.clock().Before(entry.expires) {
+		return nil, false
+	}
+	// Callers sort the records in place.
+	return append([]dnsRecord(nil), entry.records...), true
+}
+
+// store caches an answer for the smallest TTL of its records, or for
+// dnsNegativeTTL if it has none.
+func (r *DNSResolver) store(key string, records []dnsRecord) {
+	ttl := dnsNegativeTTL
+	for i, record := range records {
+		if d := time.Duration(record.ttl) * time.Second; i == 0 || d < ttl {
+			ttl = d
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock()
+	if r.cache == nil {
+		r.cache = map[string]dnsCacheEntry{}
+	}
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= maxDNSCacheEntries {
+		for k, entry := range r.cache {
+			if !now.Before(entry.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxDNSCacheEntries {
+			return
+		}
+	}
+	r.cache[key] = dnsCacheEntry{records: records, expires: now.Add(ttl)}
+}
+
+func (r *DNSResolver) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// lookupIP returns the addresses of host. A failed A or AAAA query is
+// ignored as long as the other one returns addresses.
+func (r *DNSResolver) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	var (
+		ips      []net.IP
+		firstErr error
+	)
+	for _, typ := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		records, err := r.query(ctx, host, typ)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, record := range records {
+			ips = append(ips, record.ip)
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (r *DNSResolver) lookupSRV(ctx context.Context, name string) ([]dnsRecord, error) {
+	return r.query(ctx, name, dnsTypeSRV)
+}
+
+func (r *DNSResolver) lookupNAPTR(ctx context.Context, name string) ([]dnsRecord, error) {
+	return r.query(ctx, name, dnsTypeNAPTR)
+}
@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+var (
+	ErrNoVia                = errors.New("transport: message has no Via header")
+	ErrNoListener           = errors.New("transport: no listener for transport")
+	ErrNoTLSConfig          = errors.New("transport: tls listener has no TLS configuration")
+	ErrLayerClosed          = errors.New("transport: layer closed")
+	ErrFlowFailed           = errors.New("transport: flow failed")
+	ErrKeepAliveDisabled    = errors.New("transport: keepalives are not enabled")
+	ErrMessageTooLarge      = errors.New("transport: message too large")
+	ErrInvalidContentLength = errors.New("transport: invalid Content-Length")
+	ErrInvalidProxyHeader   = errors.New("transport: invalid PROXY protocol header")
+)
+
+// ErrorKind classifies the failures reported on the Errors channel.
+type ErrorKind int
+
+const (
+	ErrorKindAccept ErrorKind = iota
+	ErrorKindRead
+	ErrorKindFraming
+	ErrorKindParse
+	ErrorKindWrite
+	ErrorKindFlow
+
+	numErrorKinds
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindAccept:
+		return "accept"
+	case ErrorKindRead:
+		return "read"
+	case ErrorKindFraming:
+		return "framing"
+	case ErrorKindParse:
+		return "parse"
+	case ErrorKindWrite:
+		return "write"
+	case ErrorKindFlow:
+		return "flow"
+	}
+	return "unknown"
+}
+
+// Error describes a failure that occurred while serving a listener or a
+// connection. It is reported on the Errors channel and never stops the layer.
+type Error struct {
+	Kind       ErrorKind
+	Network    string
+	RemoteAddr net.Addr
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.RemoteAddr != nil {
+		return fmt.Sprintf("transport: %s error on %s from %s: %v", e.Kind, e.Network, e.RemoteAddr, e.Err)
+	}
+	return fmt.Sprintf("transport: %s error on %s: %v", e.Kind, e.Network, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Stats holds counters for the failures the layer has recovered from.
+type Stats struct {
+	// Errors is the number of failures per kind.
+	Errors map[ErrorKind]uint64
+	// Rejected is the number of malformed requests answered with 400.
+	Rejected uint64
+	// Dropped is the number of malformed messages that could not be answered.
+	Dropped uint64
+
+	// QueueDepth is the number of received messages waiting for the consumer.
+	QueueDepth int
+	// QueueCapacity is the size of the inbound queue.
+	QueueCapacity int
+	// Overflowed is the number of messages discarded because the queue was
+	// full.
+	Overflowed uint64
+	// Overloaded is the number of requests answered with 503 because the
+	// queue was full.
+	Overloaded uint64
+
+	// RateLimited is the number of messages dropped because their source
+	// exceeded its rate limit or was banned.
+	RateLimited uint64
+	// Banned is the number of bans issued to sources that kept exceeding
+	// their rate limit.
+	Banned uint64
+	// Denied is the number of messages and connections denied by the ACL.
+	Denied uint64
+}
+
+type counters struct {
+	errors     [numErrorKinds]atomic.Uint64
+	rejected   atomic.Uint64
+	dropped    atomic.Uint64
+	overflowed atomic.Uint64
+	overloaded atomic.Uint64
+
+	rateLimited atomic.Uint64
+	banned      atomic.Uint64
+	denied      atomic.Uint64
+}
+
+// Stats returns a snapshot of the layer counters.
+func (l *layer) Stats() Stats {
+	stats := Stats{
+		Errors:   make(map[ErrorKind]uint64, numErrorKinds),
+		Rejected: l.counters.rejected.Load(),
+		Dropped:  l.counters.dropped.Load(),
+
+		QueueDepth:    len(l.messages),
+		QueueCapacity: cap(l.messages),
+		Overflowed:    l.counters.overflowed.Load(),
+		Overloaded:    l.counters.overloaded.Load(),
+
+		RateLimited: l.counters.rateLimited.Load(),
+		Banned:      l.counters.banned.Load(),
+		Denied:      l.counters.denied.Load(),
+	}
+	for kind := ErrorKind(0); kind < numErrorKinds; kind++ {
+		stats.Errors[kind] = l.counters.errors[kind].Load()
+	}
+	return stats
+}
+
+// Errors returns the channel on which failures are reported. The channel is
+// buffered and errors are discarded when it is full, so a consumer is optional.
+func (l *layer) Errors() <-chan error {
+	return l.errors
+}
+
+// reportError counts a failure and reports it on the Errors channel. Errors
+// that occur once Shutdown has started, such as a failed send or keepalive,
+// are only counted, since the channel is closed when Shutdown returns.
+func (l *layer) reportError(kind ErrorKind, network string, remote net.Addr, err error) {
+	l.counters.errors[kind].Add(1)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closing {
+		return
+	}
+	select {
+	case l.errors <- &Error{Kind: kind, Network: network, RemoteAddr: remote, Err: err}:
+	default:
+	}
+}
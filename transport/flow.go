@@ -0,0 +1,254 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// flowMACSize is the length of the truncated HMAC that authenticates a flow
+// token.
+const flowMACSize = 10
+
+// FlowURI returns a URI of the listener msg arrived on whose user part is a
+// flow token for the flow msg arrived on. An edge proxy puts it in the
+// Record-Route or Path header field of a request it forwards, so that later
+// requests routed through it are sent over the same flow. The URI has the ob
+// parameter when the Contact of msg has it, that is when the request came
+// from a SIP Outbound client.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5626#section-5.1
+func (l *layer) FlowURI(msg *Message) sip.URI {
+	var uri sip.URI
+	if msg.Listener != nil {
+		uri = msg.Listener.URI()
+	} else {
+		uri = sip.URI{Scheme: "sip", LR: true}
+		uri.Host, uri.Port, _ = net.SplitHostPort(msg.Destination.String())
+		if msg.Transport != "udp" {
+			uri.Transport = msg.Transport
+		}
+	}
+
+	uri.User = l.flowToken(msg.ConnID, addrPort(msg.Source))
+	if contact, ok := msg.Contact(); ok && contact.Ob {
+		uri.Ob = true
+	}
+	return uri
+}
+
+// flowToken encodes a connection ID and remote address, authenticated with
+// the layer's key so that peers cannot forge tokens for other flows.
+func (l *layer) flowToken(connID uint64, remote netip.AddrPort) string {
+	b := binary.BigEndian.AppendUint64(nil, connID)
+	b = binary.BigEndian.AppendUint16(b, remote.Port())
+	b = append(b, remote.Addr().AsSlice()...)
+
+	mac := hmac.New(sha256.New, l.flowKey[:])
+	mac.Write(b)
+	n := len(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b)[:n+flowMACSize])
+}
+
+// parseFlowToken decodes a token made by flowToken. It reports false if the
+// token was not made by this layer.
+func (l *layer) parseFlowToken(token string) (uint64, netip.AddrPort, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || (len(b) != 8+2+4+flowMACSize && len(b) != 8+2+16+flowMACSize) {
+		return 0, netip.AddrPort{}, false
+	}
+
+	data, sum := b[:len(b)-flowMACSize], b[len(b)-flowMACSize:]
+	mac := hmac.New(sha256.New, l.flowKey[:])
+	mac.Write(data)
+	if !hmac.Equal(sum, mac.Sum(nil)[:flowMACSize]) {
+		return 0, netip.AddrPort{}, false
+	}
+
+	ip, _ := netip.AddrFromSlice(data[10:])
+	port := binary.BigEndian.Uint16(data[8:10])
+	return binary.BigEndian.Uint64(data[:8]), netip.AddrPortFrom(ip, port), true
+}
+
+// uriFlow returns the flow named by the flow token in uri. It reports false if
+// uri has no token made by this layer, and returns ErrFlowFailed if the flow
+// has been closed.
+func (l *layer) uriFlow(uri sip.URI) (Flow, bool, error) {
+	if uri.User == "" {
+		return Flow{}, false, nil
+	}
+	connID, remote, ok := l.parseFlowToken(uri.User)
+	if !ok {
+		return Flow{}, false, nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, s := range l.conns {
+		if s.id == connID && addrPort(s.RemoteAddr()) == remote {
+			return s.flow(), true, nil
+		}
+	}
+	for _, s := range l.sockets {
+		if s.id == connID {
+			return s.flow(net.UDPAddrFromAddrPort(remote)), true, nil
+		}
+	}
+	return Flow{}, true, ErrFlowFailed
+}
+
+// routeFlow sets the RouteFlow of a request whose next hop carries a flow
+// token. A request for a flow that has been closed is answered with 430 Flow
+// Failed and must not be delivered, in which case it returns false.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5626#section-5.3
+func (l *layer) routeFlow(msg *Message) bool {
+	uri, err := nextHop(msg)
+	if err != nil {
+		return true
+	}
+
+	flow, ok, err := l.uriFlow(uri)
+	if !ok {
+		return true
+	}
+	if err == nil {
+		msg.RouteFlow = &flow
+		return true
+	}
+
+	if msg.Method() == sip.MethodAck {
+		l.counters.dropped.Add(1)
+		return false
+	}
+	if err := l.Send(sip.NewResponse(msg, sip.StatusFlowFailed, "")); err != nil {
+		l.reportError(ErrorKindWrite, msg.Transport, msg.Source, err)
+		l.counters.dropped.Add(1)
+		return false
+	}
+	l.counters.rejected.Add(1)
+	return false
+}
+
+// SendFlow implements Layer. The transport and sent-by address of the top Via
+// of a request are set to match the flow.
+func (l *layer) SendFlow(msg sip.Message, flow Flow) error {
+	l.mu.RLock()
+	var conn *stream
+	for _, s := range l.conns {
+		if s.id == flow.ConnID {
+			conn = s
+			break
+		}
+	}
+	var sock *socket
+	for _, s := range l.sockets {
+		if s.id == flow.ConnID {
+			sock = s
+			break
+		}
+	}
+	l.mu.RUnlock()
+
+	var via *sip.Via
+	if sip.IsRequest(msg) {
+		vias, ok := msg.Via()
+		if !ok {
+			return ErrNoVia
+		}
+		via = vias[0]
+	}
+
+	switch {
+	case conn != nil:
+		if via != nil {
+			via.Transport = transportName(conn.Conn)
+			host, port := conn.listener.sentBy(conn.LocalAddr())
+			setSentBy(via, host, port)
+		}
+		_, err := conn.Write([]byte(msg.String()))
+		return err
+	case sock != nil && flow.RemoteAddr != nil:
+		if via != nil {
+			via.Transport = "udp"
+			host, port := sock.listener.sentBy(sock.LocalAddr())
+			setSentBy(via, host, port)
+		}
+		_, err := sock.WriteTo([]byte(msg.String()), flow.RemoteAddr)
+		return err
+	}
+	return ErrFlowFailed
+}
+
+// addAlias registers the connection a request arrived on for requests to the
+// sent-by address of its top Via when the Via has the alias parameter.
+// Aliases are only honored on TLS connections where the peer presented a
+// verified certificate for the sent-by host, so that a peer cannot divert
+// requests meant for someone else.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5923#section-5
+func (l *layer) addAlias(conn *stream, msg sip.Message) {
+	vias, ok := msg.Via()
+	if !ok || !vias[0].Alias {
+		return
+	}
+	via := vias[0]
+
+	tc, ok := conn.Conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || chains[0][0].VerifyHostname(via.Host) != nil {
+		return
+	}
+
+	port := via.Port
+	if port == "" {
+		port = defaultTLSPort
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.closing {
+		l.aliases[net.JoinHostPort(strings.ToLower(via.Host), port)] = conn
+	}
+}
+
+// aliasTo returns a connection aliased to the host or address of a TLS target.
+func (l *layer) aliasTo(target Target) *stream {
+	port := strconv.Itoa(target.Port)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if s, ok := l.aliases[net.JoinHostPort(strings.ToLower(target.Host), port)]; ok {
+		return s
+	}
+	return l.aliases[target.Addr()]
+}
+
+// addrPort converts a UDP or TCP address, unmapping IPv4-mapped IPv6
+// addresses so that the same peer always converts to the same value.
+func addrPort(addr net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	default:
+		ap, _ = netip.ParseAddrPort(addr.String())
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
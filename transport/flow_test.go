@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate returns a self-signed certificate for host and the pool
+// that verifies it.
+func testCertificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestFlowToken(t *testing.T) {
+	l := NewLayer()
+
+	for _, addr := range []string{"192.0.2.1:5060", "[2001:db8::1]:5061"} {
+		remote := netip.MustParseAddrPort(addr)
+		token := l.flowToken(42, remote)
+
+		connID, got, ok := l.parseFlowToken(token)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(42), connID)
+		assert.Equal(t, remote, got)
+
+		// Tokens cannot be altered or used with another layer.
+		forged := []byte(token)
+		forged[0] ^= 1
+		_, _, ok = l.parseFlowToken(string(forged))
+		assert.False(t, ok)
+		_, _, ok = NewLayer().parseFlowToken(token)
+		assert.False(t, ok)
+	}
+
+	_, _, ok := l.parseFlowToken("alice")
+	assert.False(t, ok)
+}
+
+func TestFlowRouting(t *testing.T) {
+	l := NewLayer()
+	defer l.Shutdown(context.Background())
+
+	udpAddr, err := l.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	tcpAddr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	// The client registers over TCP through the edge proxy.
+	client, err := net.Dial("tcp", tcpAddr.String())
+	assert.Nil(t, err)
+	_, err = client.Write([]byte(testRequest))
+	assert.Nil(t, err)
+
+	msg := <-l.Messages()
+	uri := l.FlowURI(msg)
+	assert.Equal(t, tcpAddr.String(), net.JoinHostPort(uri.Host, uri.Port))
+	assert.Equal(t, "tcp", uri.Transport)
+	assert.False(t, uri.Ob)
+	route := "Route: <" + uri.String() + ">\r\n"
+
+	// A SIP Outbound client marks its Contact with ob.
+	outbound := *msg
+	outbound.Message, err = sip.Parse([]byte(strings.Replace(testRequest, "Call-ID:", "Contact: <sip:alice@192.0.2.1;ob>\r\nCall-ID:", 1)))
+	assert.Nil(t, err)
+	assert.True(t, l.FlowURI(&outbound).Ob)
+
+	// A request routed to the flow is delivered with the flow, and sending it
+	// reaches the client over its connection.
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer peer.Close()
+
+	req := strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1", "SIP/2.0/UDP 127.0.0.1;rport", 1)
+	req = strings.Replace(req, "Call-ID:", route+"Call-ID:", 1)
+	_, err = peer.WriteTo([]byte(req), udpAddr)
+	assert.Nil(t, err)
+
+	msg = <-l.Messages()
+	assert.NotNil(t, msg.RouteFlow)
+	assert.Equal(t, client.LocalAddr().String(), msg.RouteFlow.RemoteAddr.String())
+
+	forward, err := sip.Parse([]byte(strings.Replace(testRequest, "Call-ID:", route+"Call-ID:", 1)))
+	assert.Nil(t, err)
+	vias, _ := forward.Via()
+	vias[0].Host = ""
+	targets, err := l.Locate(context.Background(), forward)
+	assert.Nil(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, client.LocalAddr().String(), targets[0].Addr())
+	assert.NotNil(t, targets[0].Flow)
+	assert.Nil(t, l.Send(forward))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "OPTIONS sip:bob@biloxi.com SIP/2.0\r\n", line)
+
+	// Once the connection is gone, requests for the flow fail with 430.
+	client.Close()
+	assert.Eventually(t, func() bool {
+		_, _, err := l.uriFlow(uri)
+		return err != nil
+	}, time.Second, time.Millisecond)
+
+	assert.ErrorIs(t, l.Send(forward), ErrFlowFailed)
+
+	_, err = peer.WriteTo([]byte(req), udpAddr)
+	assert.Nil(t, err)
+
+	buf := make([]byte, maxPacketSize)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "SIP/2.0 430 Flow Failed\r\n"))
+}
+
+func TestAlias(t *testing.T) {
+	serverCert, serverPool := testCertificate(t, "sip.example.com")
+	clientCert, clientPool := testCertificate(t, "client.example.com")
+
+	l := NewLayer()
+	defer l.Shutdown(context.Background())
+
+	addr, err := l.Listen(context.Background(), "tls", "127.0.0.1:0", WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}))
+	assert.Nil(t, err)
+
+	client, err := tls.Dial("tcp", addr.String(), &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      serverPool,
+		ServerName:   "sip.example.com",
+	})
+	assert.Nil(t, err)
+	defer client.Close()
+
+	for _, via := range []string{
+		// The certificate is not valid for this host, so the alias is ignored.
+		"SIP/2.0/TLS attacker.example.com;branch=z9hG4bK1;alias",
+		"SIP/2.0/TLS client.example.com;branch=z9hG4bK2;alias",
+	} {
+		_, err = client.Write([]byte(strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1;branch=z9hG4bK776asdhds", via, 1)))
+		assert.Nil(t, err)
+		<-l.Messages()
+	}
+
+	assert.Nil(t, l.aliasTo(Target{Transport: "tls", Host: "attacker.example.com", IP: net.IPv4(192, 0, 2, 1), Port: 5061}))
+
+	// A request to the client reuses its connection instead of connecting to
+	// the port it would listen on.
+	req, err := sip.Parse([]byte(testRequest))
+	assert.Nil(t, err)
+	vias, _ := req.Via()
+	vias[0].Host = ""
+
+	target := Target{Transport: "tls", Host: "client.example.com", IP: net.IPv4(127, 0, 0, 1), Port: 5061}
+	assert.Nil(t, l.SendTo(req, target))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "OPTIONS sip:bob@biloxi.com SIP/2.0\r\n", line)
+}
@@ -0,0 +1,244 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Flow describes a connection between the layer and a peer.
+type Flow struct {
+	ConnID     uint64
+	Transport  string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+func (s *stream) flow() Flow {
+	return Flow{
+		ConnID:     s.id,
+		Transport:  transportName(s.Conn),
+		LocalAddr:  s.LocalAddr(),
+		RemoteAddr: s.RemoteAddr(),
+	}
+}
+
+// Dial opens a connection-oriented flow to address. Requests and responses to
+// the peer reuse the flow, and when keepalives are enabled it is monitored
+// with CRLF pings.
+func (l *layer) Dial(ctx context.Context, network, address string) (Flow, error) {
+	s, err := l.dial(ctx, network, address, nil)
+	if err != nil {
+		return Flow{}, err
+	}
+	return s.flow(), nil
+}
+
+// keepAlive sends a double CRLF ping on s at the configured interval, reduced
+// by a random amount of up to 20 percent, and declares the flow failed when
+// the pong does not arrive within the timeout.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.1
+func (l *layer) keepAlive(s *stream) {
+	for {
+		interval := l.opts.keepAliveInterval
+		interval -= time.Duration(rand.Int63n(int64(interval/5) + 1))
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// Discard a pong that arrived late for the previous ping.
+		select {
+		case <-s.pong:
+		default:
+		}
+
+		if _, err := s.Write(doubleCRLF); err != nil {
+			l.flowFailed(s, err)
+			return
+		}
+
+		timer = time.NewTimer(l.opts.keepAliveTimeout)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.pong:
+			timer.Stop()
+		case <-timer.C:
+			l.flowFailed(s, ErrFlowFailed)
+			return
+		}
+	}
+}
+
+// flowFailed closes a flow that stopped answering keepalives and notifies the
+// flow failure handler.
+func (l *layer) flowFailed(s *stream, err error) {
+	if l.isClosing() {
+		return
+	}
+
+	s.Close()
+	l.notifyFlowFailed(s.flow(), err)
+}
+
+func (l *layer) notifyFlowFailed(flow Flow, err error) {
+	l.reportError(ErrorKindFlow, flow.Transport, flow.RemoteAddr, err)
+
+	if l.opts.flowFailed != nil {
+		l.opts.flowFailed(flow, err)
+	}
+}
+
+func (s *socket) flow(remote net.Addr) Flow {
+	return Flow{
+		ConnID:     s.id,
+		Transport:  networkName(s.LocalAddr().Network()),
+		LocalAddr:  s.LocalAddr(),
+		RemoteAddr: remote,
+	}
+}
+
+// handleSTUN answers STUN Binding requests received on a SIP socket and
+// hands Binding responses to the waiting transaction.
+func (l *layer) handleSTUN(conn *socket, addr net.Addr, b []byte) {
+	m, err := parseSTUN(b)
+	if err != nil {
+		l.reportError(ErrorKindParse, networkName(conn.LocalAddr().Network()), addr, err)
+		return
+	}
+
+	switch m.typ {
+	case stunBindingRequest:
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return
+		}
+		res := &stunMessage{typ: stunBindingResponse, txID: m.txID, mapped: udpAddr}
+		if _, err := conn.WriteTo(res.marshal(), addr); err != nil {
+			l.reportError(ErrorKindWrite, networkName(conn.LocalAddr().Network()), addr, err)
+		}
+
+	case stunBindingResponse:
+		l.mu.RLock()
+		ch, ok := l.stun[m.txID]
+		l.mu.RUnlock()
+		if ok && m.mapped != nil {
+			select {
+			case ch <- m.mapped:
+			default:
+			}
+		}
+	}
+}
+
+// Binding implements Layer. The request is retransmitted with an interval
+// starting at 500 ms and doubling until a response arrives or ctx is done.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5389#section-7.2.1
+func (l *layer) Binding(ctx context.Context, address string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := l.socketFor(addr.IP, "")
+	if conn == nil {
+		return nil, ErrNoListener
+	}
+
+	req := newSTUNBindingRequest()
+	ch := make(chan *net.UDPAddr, 1)
+
+	l.mu.Lock()
+	l.stun[req.txID] = ch
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.stun, req.txID)
+		l.mu.Unlock()
+	}()
+
+	b := req.marshal()
+	rto := 500 * time.Millisecond
+	for {
+		if _, err := conn.WriteTo(b, addr); err != nil {
+			return nil, err
+		}
+
+		timer := time.NewTimer(rto)
+		select {
+		case mapped := <-ch:
+			timer.Stop()
+			return mapped, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+			rto *= 2
+		}
+	}
+}
+
+// KeepAlivePacket implements Layer. A Binding request is sent at the keepalive
+// interval. The flow fails when no response arrives within the keepalive
+// timeout or when the public address changes, which means that the NAT binding
+// has been lost.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.2
+func (l *layer) KeepAlivePacket(ctx context.Context, address string) error {
+	if l.opts.keepAliveInterval <= 0 {
+		return ErrKeepAliveDisabled
+	}
+
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	conn := l.socketFor(remote.IP, "")
+	if conn == nil {
+		return ErrNoListener
+	}
+
+	var public *net.UDPAddr
+	for {
+		bindCtx, cancel := context.WithTimeout(ctx, l.opts.keepAliveTimeout)
+		mapped, err := l.Binding(bindCtx, address)
+		cancel()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && public != nil && mapped.String() != public.String() {
+			err = ErrFlowFailed
+		}
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = ErrFlowFailed
+			}
+			l.notifyFlowFailed(conn.flow(remote), err)
+			return err
+		}
+		public = mapped
+
+		interval := l.opts.keepAliveInterval
+		interval -= time.Duration(rand.Int63n(int64(interval/5) + 1))
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadStreamFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("\r\n\r\n\r\nOPTIONS sip:bob@biloxi.com SIP/2.0\r\n\r\n"))
+
+	f, _, err := readStreamFrame(r, false)
+	assert.Nil(t, err)
+	assert.Equal(t, framePing, f)
+
+	f, b, err := readStreamFrame(r, false)
+	assert.Nil(t, err)
+	assert.Equal(t, frameMessage, f)
+	assert.True(t, strings.HasPrefix(string(b), "OPTIONS"))
+
+	r = bufio.NewReader(strings.NewReader("\r\n"))
+	f, _, err = readStreamFrame(r, true)
+	assert.Nil(t, err)
+	assert.Equal(t, framePong, f)
+}
+
+func TestKeepAlivePong(t *testing.T) {
+	l := NewLayer()
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("\r\n\r\n"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "\r\n", string(buf[:n]))
+}
+
+func TestKeepAliveFlowFailed(t *testing.T) {
+	// A peer that accepts connections but never answers pings.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1024))
+			time.Sleep(time.Second)
+		}
+	}()
+
+	failed := make(chan Flow, 1)
+	l := NewLayer(
+		WithKeepAlive(20*time.Millisecond, 20*time.Millisecond),
+		WithFlowFailed(func(flow Flow, err error) {
+			assert.ErrorIs(t, err, ErrFlowFailed)
+			failed <- flow
+		}),
+	)
+
+	flow, err := l.Dial(context.Background(), "tcp", listener.Addr().String())
+	assert.Nil(t, err)
+
+	select {
+	case f := <-failed:
+		assert.Equal(t, flow.ConnID, f.ConnID)
+	case <-time.After(time.Second):
+		t.Fatal("flow failure was not reported")
+	}
+}
+
+func TestKeepAliveHealthyFlow(t *testing.T) {
+	server := NewLayer()
+	addr, err := server.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+
+	failed := make(chan Flow, 1)
+	client := NewLayer(
+		WithKeepAlive(10*time.Millisecond, 50*time.Millisecond),
+		WithFlowFailed(func(flow Flow, err error) {
+			failed <- flow
+		}),
+	)
+	defer client.Shutdown(context.Background())
+
+	_, err = client.Dial(context.Background(), "tcp", addr.String())
+	assert.Nil(t, err)
+
+	select {
+	case <-failed:
+		t.Fatal("healthy flow reported as failed")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
@@ -1,83 +1,628 @@
 package transport
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
-	"fmt"
-	"io"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"net"
-	"strings"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nilssonr/sip/sip"
 )
 
+// errorBufferSize is the number of errors buffered on the Errors channel.
+const errorBufferSize = 64
+
+// Layer is the SIP transport layer. It receives messages on any number of
+// listeners, delivers them on the Messages channel and sends messages to the
+// network.
+type Layer interface {
+	// Listen binds to address and serves it in the background until ctx is
+	// done or the layer is shut down. It returns the bound address.
+	Listen(ctx context.Context, network string, address string, opts ...ListenOption) (net.Addr, error)
+	// Serve accepts stream connections on listener until ctx is done or the
+	// layer is shut down.
+	Serve(ctx context.Context, listener net.Listener, opts ...ListenOption) error
+	// ServePacket reads datagrams from conn until ctx is done or the layer is
+	// shut down.
+	ServePacket(ctx context.Context, conn net.PacketConn, opts ...ListenOption) error
+	// Listeners returns the listeners of the layer.
+	Listeners() []Listener
+	// SetACL replaces the access control list.
+	SetACL(acl ACL)
+	// Shutdown stops accepting connections and reading messages, waits until
+	// the messages already read have been delivered and then closes all
+	// connections and the Messages and Errors channels. If ctx expires first
+	// the undelivered messages are discarded and ctx.Err() is returned.
+	Shutdown(ctx context.Context) error
+	// Dial opens a connection-oriented flow to address.
+	Dial(ctx context.Context, network string, address string) (Flow, error)
+	// Binding sends a STUN Binding request to address over UDP and returns
+	// the public address the peer saw the request come from.
+	Binding(ctx context.Context, address string) (*net.UDPAddr, error)
+	// KeepAlivePacket monitors the UDP flow to address with STUN keepalives
+	// until ctx is done.
+	KeepAlivePacket(ctx context.Context, address string) error
+
+	// Send sends a request to the next hop or a response to the previous hop.
+	Send(msg sip.Message) error
+	// SendTo sends a request to a target returned by Locate or Resolve.
+	// Client transactions send their request, its retransmissions and its
+	// ACK to the same target with it.
+	SendTo(msg sip.Message, target Target) error
+	// SendFlow sends a message over a flow, such as the RouteFlow of a
+	// received request. It returns ErrFlowFailed if the flow has been closed.
+	SendFlow(msg sip.Message, flow Flow) error
+	// FlowURI returns a URI for Record-Route and Path header fields that
+	// routes later requests over the flow msg arrived on.
+	FlowURI(msg *Message) sip.URI
+	// Locate returns the targets a request is sent to, in the order they
+	// are tried: the flow of a next hop with a flow token, and otherwise
+	// the resolved targets of the next hop.
+	Locate(ctx context.Context, msg sip.Message) ([]Target, error)
+	// Resolve locates the targets a request for uri should be sent to.
+	Resolve(ctx context.Context, uri sip.URI) ([]Target, error)
+	Messages() <-chan *Message
+	Errors() <-chan error
+	Stats() Stats
+}
+
 type layer struct {
-	messages chan sip.Message
+	opts     options
+	messages chan *Message
+	errors   chan error
+	counters counters
+
+	nextConnID atomic.Uint64
+
+	// wg tracks the goroutines that may deliver messages or report errors.
+	wg sync.WaitGroup
+	// done is closed to abandon delivery when Shutdown runs out of time.
+	done chan struct{}
+	// workers tracks the goroutines that run the handler.
+	workers sync.WaitGroup
+
+	mu        sync.RWMutex
+	closing   bool
+	closed    bool
+	listeners map[net.Listener]*Listener
+	sockets   []*socket
+	// bound holds the listeners and sockets in the order they were added.
+	bound []*Listener
+	conns map[string]*stream
+	// aliases maps the sent-by addresses of peers that asked for connection
+	// reuse to their connections.
+	aliases map[string]*stream
+	// peers remembers the socket each peer sends to, for responses.
+	peers peerTable
+	// origins remembers the connection each request arrived on, for
+	// responses.
+	origins originTable
+	// limiter is nil when rate limiting is disabled.
+	limiter *rateLimiter
+	acl     atomic.Pointer[ACL]
+
+	// flowKey authenticates flow tokens.
+	flowKey [32]byte
+	// stun holds the STUN Binding transactions waiting for a response.
+	stun map[[12]byte]chan *net.UDPAddr
 }
 
-func NewLayer() layer {
-	return layer{
-		messages: make(chan sip.Message),
+func NewLayer(opts ...Option) *layer {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.resolver == nil {
+		o.resolver = NewDNSResolver("")
+	}
+
+	l := &layer{
+		opts:      o,
+		messages:  make(chan *Message, o.queueSize),
+		errors:    make(chan error, errorBufferSize),
+		done:      make(chan struct{}),
+		listeners: map[net.Listener]*Listener{},
+		conns:     map[string]*stream{},
+		aliases:   map[string]*stream{},
+		stun:      map[[12]byte]chan *net.UDPAddr{},
+	}
+
+	if o.rateLimit != nil {
+		l.limiter = newRateLimiter(*o.rateLimit)
+	}
+	if o.acl != nil {
+		l.acl.Store(o.acl)
+	}
+	if _, err := rand.Read(l.flowKey[:]); err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < o.workers; i++ {
+		l.workers.Add(1)
+		go func() {
+			defer l.workers.Done()
+			for msg := range l.messages {
+				o.handler(msg)
+			}
+		}()
 	}
+
+	return l
 }
 
-// Listen implements Layer.
-func (l *layer) Listen(network string, address string) error {
-	listener, err := net.Listen(network, address)
+// Listen implements Layer. The "tls" network listens on TCP and requires a
+// TLS configuration, see WithTLSConfig.
+func (l *layer) Listen(ctx context.Context, network string, address string, opts ...ListenOption) (net.Addr, error) {
+	lo, err := newListenOptions(opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for {
-		conn, err := listener.Accept()
+	var lc net.ListenConfig
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		conn, err := lc.ListenPacket(ctx, network, address)
 		if err != nil {
-			fmt.Println(err)
-			break
+			return nil, err
+		}
+		s, err := l.addSocket(conn, lo)
+		if err != nil {
+			return nil, err
+		}
+		go l.runSocket(ctx, s)
+		return conn.LocalAddr(), nil
+	case "tls":
+		if lo.tlsConfig == nil {
+			return nil, ErrNoTLSConfig
 		}
+		network = "tcp"
+	}
+
+	listener, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	listener, ln := l.wrapListener(listener, lo)
+	if err := l.addListener(listener, ln); err != nil {
+		return nil, err
+	}
+	go l.runListener(ctx, listener, ln)
+	return listener.Addr(), nil
+}
+
+// Serve implements Layer.
+func (l *layer) Serve(ctx context.Context, listener net.Listener, opts ...ListenOption) error {
+	lo, err := newListenOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	listener, ln := l.wrapListener(listener, lo)
+	if err := l.addListener(listener, ln); err != nil {
+		return err
+	}
+	return l.runListener(ctx, listener, ln)
+}
+
+// ServePacket implements Layer.
+func (l *layer) ServePacket(ctx context.Context, conn net.PacketConn, opts ...ListenOption) error {
+	lo, err := newListenOptions(opts)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 
-		go func(r io.ReadWriter) {
-			reader := bufio.NewReader(r)
-			buffer := bytes.Buffer{}
+	s, err := l.addSocket(conn, lo)
+	if err != nil {
+		return err
+	}
+	return l.runSocket(ctx, s)
+}
 
-			for {
-				line, err := reader.ReadBytes('\n')
-				if err != nil {
-					if errors.Is(err, io.EOF) {
-						fmt.Println("client hung up")
-						break
-					}
+func newListenOptions(opts []ListenOption) (listenOptions, error) {
+	var lo listenOptions
+	for _, opt := range opts {
+		opt(&lo)
+	}
+	return lo, lo.err
+}
 
-					panic(err)
-				}
+// wrapListener applies the listen options that change what Accept returns and
+// describes the resulting listener. The PROXY protocol header precedes the TLS
+// handshake, so it is read first.
+func (l *layer) wrapListener(listener net.Listener, lo listenOptions) (net.Listener, *Listener) {
+	transport := networkName(listener.Addr().Network())
 
-				buffer.Write(line)
+	if lo.proxy {
+		listener = newProxyListener(listener, lo.trusted, proxyHooks{
+			begin: l.track,
+			end:   l.wg.Done,
+			onError: func(addr net.Addr, err error) {
+				l.reportError(ErrorKindFraming, transport, addr, err)
+			},
+		})
+	}
+	if lo.tlsConfig != nil {
+		listener = tls.NewListener(listener, lo.tlsConfig)
+		transport = "tls"
+	}
+	return listener, newListener(transport, listener.Addr(), lo)
+}
 
-				if strings.HasSuffix(buffer.String(), "\r\n\r\n") {
-					fmt.Println(buffer.String())
-					msg, err := sip.Parse(buffer.Bytes())
-					if err != nil {
-						panic(err)
-					}
+// track adds a goroutine that may report errors to the ones Shutdown waits
+// for. It returns false once the layer is closing.
+func (l *layer) track() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-					l.messages <- msg
-				}
-			}
-		}(conn)
+	if l.closing {
+		return false
 	}
+	l.wg.Add(1)
+	return true
+}
+
+// addListener registers a listener so that Shutdown waits for it. Listeners
+// are registered before they are served so that a Shutdown right after Listen
+// returns cannot miss them.
+func (l *layer) addListener(listener net.Listener, ln *Listener) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
+	if l.closing {
+		listener.Close()
+		return ErrLayerClosed
+	}
+	l.listeners[listener] = ln
+	l.bound = append(l.bound, ln)
+	l.wg.Add(1)
 	return nil
 }
 
+func (l *layer) runListener(ctx context.Context, listener net.Listener, ln *Listener) error {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.listeners, listener)
+		l.unbind(ln)
+		l.mu.Unlock()
+	}()
+
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	return l.serveStream(ctx, listener, ln)
+}
+
+// addSocket registers a datagram socket, see addListener.
+func (l *layer) addSocket(conn net.PacketConn, lo listenOptions) (*socket, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closing {
+		conn.Close()
+		return nil, ErrLayerClosed
+	}
+	s := &socket{
+		PacketConn: conn,
+		id:         l.nextConnID.Add(1),
+		listener:   newListener("udp", conn.LocalAddr(), lo),
+	}
+	l.sockets = append(l.sockets, s)
+	l.bound = append(l.bound, s.listener)
+	l.wg.Add(1)
+	return s, nil
+}
+
+func (l *layer) runSocket(ctx context.Context, s *socket) error {
+	defer l.wg.Done()
+
+	// The socket stays open during Shutdown so that responses to the messages
+	// being drained can still be sent. Shutdown closes it.
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if !l.closing {
+			l.removeSocket(s)
+			s.Close()
+		}
+	})
+	defer stop()
+
+	return l.servePacket(ctx, s)
+}
+
+// removeSocket unregisters a socket. It must be called with l.mu held.
+func (l *layer) removeSocket(s *socket) {
+	for i, other := range l.sockets {
+		if other == s {
+			l.sockets = append(l.sockets[:i:i], l.sockets[i+1:]...)
+			break
+		}
+	}
+	l.unbind(s.listener)
+	l.peers.remove(s)
+}
+
+// unbind removes a listener from the list returned by Listeners. It must be
+// called with l.mu held.
+func (l *layer) unbind(ln *Listener) {
+	for i, other := range l.bound {
+		if other == ln {
+			l.bound = append(l.bound[:i:i], l.bound[i+1:]...)
+			return
+		}
+	}
+}
+
+// Shutdown implements Layer.
+func (l *layer) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	if l.closing {
+		l.mu.Unlock()
+		return ErrLayerClosed
+	}
+	l.closing = true
+
+	for listener := range l.listeners {
+		listener.Close()
+	}
+	for _, conn := range l.sockets {
+		conn.SetReadDeadline(time.Now())
+	}
+	for _, conn := range l.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	l.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		close(l.done)
+		<-drained
+	}
+
+	close(l.messages)
+
+	if err == nil {
+		handled := make(chan struct{})
+		go func() {
+			l.workers.Wait()
+			close(handled)
+		}()
+
+		select {
+		case <-handled:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	l.mu.Lock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	for _, conn := range l.sockets {
+		conn.Close()
+	}
+	l.closed = true
+	close(l.errors)
+	l.mu.Unlock()
+
+	return err
+}
+
+// Send implements Layer. Requests are sent to the servers located for the
+// top Route or the Request-URI, trying the next server when sending fails.
+// Responses are sent to the address derived from the top Via header field as
+// described in RFC 3261 section 18.2.2.
 func (l *layer) Send(msg sip.Message) error {
+	l.mu.RLock()
+	closed := l.closed
+	l.mu.RUnlock()
+	if closed {
+		return ErrLayerClosed
+	}
+
 	if sip.IsRequest(msg) {
-		panic("unimplemented")
+		return l.sendRequest(context.Background(), msg)
 	}
 
-	return nil
+	vias, ok := msg.Via()
+	if !ok {
+		return ErrNoVia
+	}
+
+	return l.sendResponse(vias[0], []byte(msg.String()))
+}
+
+// handleInvalid answers a request that failed to parse with 400 Bad Request
+// if it carries enough header fields to build a response, and drops it
+// otherwise. conn is the stream connection the request arrived on, if any.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-21.4.1
+func (l *layer) handleInvalid(network string, source net.Addr, conn *stream, msg sip.Message, err error) {
+	l.reportError(ErrorKindParse, network, source, err)
+
+	if msg == nil || !sip.IsRequest(msg) || msg.Method() == sip.MethodAck || !answerable(msg) {
+		l.counters.dropped.Add(1)
+		return
+	}
+
+	stampVia(msg, source)
+	if vias, ok := msg.Via(); ok && conn != nil {
+		l.origins.add(vias[0], conn, time.Now())
+	}
+	if err := l.Send(sip.NewResponse(msg, sip.StatusBadRequest, "")); err != nil {
+		l.reportError(ErrorKindWrite, network, source, err)
+		l.counters.dropped.Add(1)
+		return
+	}
+	l.counters.rejected.Add(1)
+}
+
+// answerable reports whether msg has the header fields that must be copied
+// into a response.
+func answerable(msg sip.Message) bool {
+	for _, name := range []string{"via", "from", "to", "call-id", "cseq"} {
+		if len(msg.GetHeaders(name)) == 0 {
+			return false
+		}
+	}
+	return true
 }
 
 // Messages implements Layer.
-func (l *layer) Messages() <-chan sip.Message {
+func (l *layer) Messages() <-chan *Message {
 	return l.messages
 }
+
+// deliver queues msg for the consumer of the Messages channel unless Shutdown
+// has given up on draining. When the queue is full the overflow policy decides
+// whether to wait, drop the message or reject it. Requests for a flow that
+// has failed are answered and not queued.
+func (l *layer) deliver(msg *Message) {
+	if sip.IsRequest(msg) && !l.routeFlow(msg) {
+		return
+	}
+
+	if l.opts.overflow == OverflowBlock {
+		select {
+		case l.messages <- msg:
+		case <-l.done:
+		}
+		return
+	}
+
+	select {
+	case l.messages <- msg:
+		return
+	case <-l.done:
+		return
+	default:
+	}
+
+	l.counters.overflowed.Add(1)
+
+	if l.opts.overflow != OverflowReject || !sip.IsRequest(msg) || msg.Method() == sip.MethodAck {
+		return
+	}
+
+	res := sip.NewResponse(msg, sip.StatusServiceUnavailable, "")
+	res.AppendHeader(sip.RetryAfter(strconv.Itoa(int(l.opts.retryAfter.Seconds()))))
+	if err := l.Send(res); err != nil {
+		l.reportError(ErrorKindWrite, msg.Transport, msg.Source, err)
+		return
+	}
+	l.counters.overloaded.Add(1)
+}
+
+func (l *layer) isClosing() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.closing
+}
+
+// serveConn registers a stream connection and reads from it in a new
+// goroutine. Outbound connections are the ones the layer initiated and are
+// kept alive with CRLF pings when keepalives are enabled. It returns nil and
+// closes conn if the layer is shutting down.
+func (l *layer) serveConn(conn net.Conn, ln *Listener, outbound bool) *stream {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closing {
+		conn.Close()
+		return nil
+	}
+
+	s := newStream(conn, l.nextConnID.Add(1), ln, outbound)
+	l.conns[conn.RemoteAddr().String()] = s
+	l.wg.Add(1)
+	go l.readStream(s)
+
+	if outbound && l.opts.keepAliveInterval > 0 {
+		go l.keepAlive(s)
+	}
+	return s
+}
+
+// removeConn closes a connection whose reader has stopped. While shutting down
+// connections are left open until Shutdown closes them, so that responses to
+// drained messages can still be sent.
+func (l *layer) removeConn(s *stream) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	close(s.done)
+	if l.closing {
+		return
+	}
+
+	s.Close()
+	l.origins.remove(s)
+	key := s.RemoteAddr().String()
+	if l.conns[key] == s {
+		delete(l.conns, key)
+	}
+	for alias, conn := range l.aliases {
+		if conn == s {
+			delete(l.aliases, alias)
+		}
+	}
+}
+
+// connTo returns the open stream connection to exactly addr.
+func (l *layer) connTo(addr string) *stream {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.conns[addr]
+}
+
+// socketFor returns the socket to send to ip from, see pickListener.
+func (l *layer) socketFor(ip net.IP, name string) *socket {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	listeners := make([]*Listener, len(l.sockets))
+	for i, s := range l.sockets {
+		listeners[i] = s.listener
+	}
+	ln := pickListener(listeners, ip, name)
+	for _, s := range l.sockets {
+		if s.listener == ln {
+			return s
+		}
+	}
+	return nil
+}
+
+// listenerFor returns the stream listener of transport to open connections to
+// ip from, see pickListener.
+func (l *layer) listenerFor(transport string, ip net.IP, name string) *Listener {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var listeners []*Listener
+	for _, ln := range l.bound {
+		if ln.Transport == transport {
+			listeners = append(listeners, ln)
+		}
+	}
+	return pickListener(listeners, ip, name)
+}
@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRequest = "OPTIONS sip:bob@biloxi.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/TCP 127.0.0.1;branch=z9hG4bK776asdhds\r\n" +
+	"To: <sip:bob@biloxi.com>\r\n" +
+	"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+	"Call-ID: a84b4c76e66710\r\n" +
+	"CSeq: 63104 OPTIONS\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func TestShutdownDrainsMessages(t *testing.T) {
+	l := NewLayer()
+
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte(testRequest))
+	assert.Nil(t, err)
+
+	// Wait until the message has been read and is waiting for delivery.
+	assert.Eventually(t, func() bool {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		return len(l.conns) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- l.Shutdown(context.Background())
+	}()
+
+	msg, ok := <-l.Messages()
+	assert.True(t, ok)
+	assert.Equal(t, "OPTIONS", msg.Method())
+
+	assert.Nil(t, <-shutdown)
+
+	_, ok = <-l.Messages()
+	assert.False(t, ok)
+
+	_, err = net.Dial("tcp", addr.String())
+	assert.NotNil(t, err)
+
+	assert.ErrorIs(t, l.Shutdown(context.Background()), ErrLayerClosed)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	l := NewLayer()
+
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte(testRequest))
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, l.Shutdown(ctx), context.DeadlineExceeded)
+
+	_, ok := <-l.Messages()
+	assert.False(t, ok)
+}
+
+func TestOverflowReject(t *testing.T) {
+	l := NewLayer(WithQueueSize(1), WithOverflowPolicy(OverflowReject), WithRetryAfter(10*time.Second))
+
+	addr, err := l.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	req := strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1", "SIP/2.0/UDP 127.0.0.1;rport", 1)
+	for i := 0; i < 2; i++ {
+		_, err = client.WriteTo([]byte(req), addr)
+		assert.Nil(t, err)
+	}
+
+	buf := make([]byte, maxPacketSize)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "SIP/2.0 503 Service Unavailable\r\n"))
+	assert.Contains(t, string(buf[:n]), "Retry-After: 10\r\n")
+
+	stats := l.Stats()
+	assert.Equal(t, 1, stats.QueueDepth)
+	assert.Equal(t, 1, stats.QueueCapacity)
+	assert.Equal(t, uint64(1), stats.Overflowed)
+	assert.Equal(t, uint64(1), stats.Overloaded)
+}
+
+func TestHandlerWorkers(t *testing.T) {
+	received := make(chan *Message, 1)
+	l := NewLayer(WithHandler(2, func(msg *Message) {
+		received <- msg
+	}))
+
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte(testRequest))
+	assert.Nil(t, err)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "OPTIONS", msg.Method())
+	case <-time.After(time.Second):
+		t.Fatal("handler was not called")
+	}
+
+	assert.Nil(t, l.Shutdown(context.Background()))
+}
+
+func TestReportErrorAfterShutdown(t *testing.T) {
+	l := NewLayer()
+	assert.Nil(t, l.Shutdown(context.Background()))
+
+	// Failures of sends and keepalives after Shutdown are only counted.
+	l.reportError(ErrorKindFlow, "udp", nil, ErrFlowFailed)
+	assert.Equal(t, uint64(1), l.Stats().Errors[ErrorKindFlow])
+
+	_, ok := <-l.Errors()
+	assert.False(t, ok)
+}
@@ -0,0 +1,218 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// Listener describes an address the layer listens on.
+type Listener struct {
+	// Name identifies the listener in Target.Listener. It defaults to the
+	// transport and bound address, as in "udp:192.0.2.1:5060".
+	Name string
+	// Transport is the lowercase transport name: "udp", "tcp" or "tls".
+	Transport string
+	// Addr is the bound address.
+	Addr net.Addr
+	// Host and Port are the address advertised in the Via of requests sent
+	// from the listener and in Record-Route, for listeners behind NAT. An
+	// empty Host means that the local address of the socket is used.
+	Host string
+	Port string
+	// Internal marks a listener facing the internal network. Requests for
+	// private, loopback and link-local addresses are sent from internal
+	// listeners, and requests for other addresses from external ones.
+	Internal bool
+
+	// tlsConfig is the configuration of TLS listeners, also used for the
+	// connections they originate.
+	tlsConfig *tls.Config
+}
+
+func newListener(transport string, addr net.Addr, lo listenOptions) *Listener {
+	ln := &Listener{
+		Name:      lo.name,
+		Transport: transport,
+		Addr:      addr,
+		Host:      lo.host,
+		Internal:  lo.internal,
+		tlsConfig: lo.tlsConfig,
+	}
+	if ln.Name == "" {
+		ln.Name = transport + ":" + addr.String()
+	}
+
+	if ln.Host == "" {
+		if ip := addrIP(addr); ip != nil && !ip.IsUnspecified() {
+			ln.Host = ip.String()
+		}
+	}
+	if lo.port != 0 {
+		ln.Port = strconv.Itoa(lo.port)
+	} else if ln.Host != "" {
+		_, ln.Port, _ = net.SplitHostPort(addr.String())
+	}
+	return ln
+}
+
+// URI returns the URI that identifies the listener in Record-Route and Path
+// header fields.
+func (ln *Listener) URI() sip.URI {
+	uri := sip.URI{Scheme: "sip", Host: ln.Host, Port: ln.Port, LR: true}
+	if uri.Host == "" {
+		uri.Host, uri.Port, _ = net.SplitHostPort(ln.Addr.String())
+	}
+	if ln.Transport != "udp" {
+		uri.Transport = ln.Transport
+	}
+	return uri
+}
+
+// sentBy returns the address to put in the Via of requests sent on a
+// connection or socket with local address local.
+func (ln *Listener) sentBy(local net.Addr) (string, string) {
+	if ln != nil && ln.Host != "" {
+		return ln.Host, ln.Port
+	}
+	host, port, _ := net.SplitHostPort(local.String())
+	return host, port
+}
+
+// Listeners returns the listeners of the layer in the order they were added.
+func (l *layer) Listeners() []Listener {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var out []Listener
+	for _, ln := range l.bound {
+		out = append(out, *ln)
+	}
+	return out
+}
+
+// pickListener returns the listener to send to ip from among the listeners of
+// a transport: the listener called name if a name is given, and otherwise the
+// first listener of the address family of ip that faces the same network,
+// the first listener of the family, or the first listener. It returns nil if
+// there is no such listener.
+func pickListener(listeners []*Listener, ip net.IP, name string) *Listener {
+	if name != "" {
+		for _, ln := range listeners {
+			if ln.Name == name {
+				return ln
+			}
+		}
+		return nil
+	}
+
+	internal := isInternal(ip)
+
+	var sameFamily *Listener
+	for _, ln := range listeners {
+		if !familyMatches(addrIP(ln.Addr), ip) {
+			continue
+		}
+		if ln.Internal == internal {
+			return ln
+		}
+		if sameFamily == nil {
+			sameFamily = ln
+		}
+	}
+	if sameFamily != nil {
+		return sameFamily
+	}
+	if len(listeners) > 0 {
+		return listeners[0]
+	}
+	return nil
+}
+
+// isInternal reports whether ip is an address of an internal network.
+func isInternal(ip net.IP) bool {
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
+
+// familyMatches reports whether a socket bound to local can send to remote.
+// Sockets bound to the IPv6 unspecified address accept both families.
+func familyMatches(local, remote net.IP) bool {
+	if local == nil || remote == nil || (local.IsUnspecified() && local.To4() == nil) {
+		return true
+	}
+	return (local.To4() != nil) == (remote.To4() != nil)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+const (
+	// maxPeers bounds the number of peers remembered by a peerTable.
+	maxPeers = 65536
+	// peerTTL is how long a peer is remembered after its last datagram.
+	peerTTL = 5 * time.Minute
+)
+
+// peerTable remembers the socket each peer last sent a datagram to, so that
+// responses are sent from the address the peer sent the request to.
+type peerTable struct {
+	mu    sync.Mutex
+	peers map[string]peerEntry
+}
+
+type peerEntry struct {
+	socket *socket
+	seen   time.Time
+}
+
+func (t *peerTable) add(addr net.Addr, s *socket, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.peers == nil {
+		t.peers = map[string]peerEntry{}
+	}
+
+	key := addr.String()
+	if _, ok := t.peers[key]; !ok && len(t.peers) >= maxPeers {
+		for k, e := range t.peers {
+			if now.Sub(e.seen) > peerTTL {
+				delete(t.peers, k)
+			}
+		}
+		if len(t.peers) >= maxPeers {
+			return
+		}
+	}
+	t.peers[key] = peerEntry{socket: s, seen: now}
+}
+
+func (t *peerTable) get(addr net.Addr) *socket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.peers[addr.String()].socket
+}
+
+// remove forgets the peers of a closed socket.
+func (t *peerTable) remove(s *socket) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, e := range t.peers {
+		if e.socket == s {
+			delete(t.peers, k)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickListener(t *testing.T) {
+	external := &Listener{Name: "external", Addr: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 5060}}
+	internal := &Listener{Name: "internal", Addr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5060}, Internal: true}
+	ipv6 := &Listener{Name: "ipv6", Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5060}}
+	listeners := []*Listener{external, internal, ipv6}
+
+	tests := []struct {
+		IP       string
+		Name     string
+		Listener *Listener
+	}{
+		{IP: "198.51.100.1", Listener: external},
+		{IP: "10.1.2.3", Listener: internal},
+		{IP: "127.0.0.1", Listener: internal},
+		{IP: "2001:db8::2", Listener: ipv6},
+		{IP: "10.1.2.3", Name: "external", Listener: external},
+		{IP: "10.1.2.3", Name: "missing"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Listener, pickListener(listeners, net.ParseIP(test.IP), test.Name), test.IP)
+	}
+
+	// A listener of the other family is used when there is nothing better.
+	assert.Equal(t, ipv6, pickListener([]*Listener{ipv6}, net.ParseIP("192.0.2.1"), ""))
+}
+
+func TestNewListener(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5061}
+
+	ln := newListener("tls", addr, listenOptions{})
+	assert.Equal(t, "tls:10.0.0.1:5061", ln.Name)
+	assert.Equal(t, "sip:10.0.0.1:5061;transport=tls;lr", ln.URI().String())
+
+	ln = newListener("tls", addr, listenOptions{name: "edge", host: "sip.example.com", port: 443})
+	assert.Equal(t, "edge", ln.Name)
+	assert.Equal(t, "sip:sip.example.com:443;transport=tls;lr", ln.URI().String())
+
+	// Listeners on the unspecified address advertise the local address of the
+	// socket a message is sent on.
+	ln = newListener("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 5060}, listenOptions{})
+	host, port := ln.sentBy(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060})
+	assert.Equal(t, "192.0.2.1", host)
+	assert.Equal(t, "5060", port)
+}
+
+func TestMultipleListeners(t *testing.T) {
+	l := NewLayer()
+	defer l.Shutdown(context.Background())
+
+	_, err := l.Listen(context.Background(), "tls", "127.0.0.1:0")
+	assert.ErrorIs(t, err, ErrNoTLSConfig)
+
+	_, err = l.Listen(context.Background(), "udp", "127.0.0.1:0", WithName("a"))
+	assert.Nil(t, err)
+	b, err := l.Listen(context.Background(), "udp", "127.0.0.1:0", WithName("b"), WithAdvertised("sip.example.com", 5080))
+	assert.Nil(t, err)
+	_, err = l.Listen(context.Background(), "tcp", "127.0.0.1:0", WithName("c"))
+	assert.Nil(t, err)
+
+	var names []string
+	for _, ln := range l.Listeners() {
+		names = append(names, ln.Name)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	req, err := sip.Parse([]byte(strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1", "SIP/2.0/UDP", 1)))
+	assert.Nil(t, err)
+	vias, _ := req.Via()
+	vias[0].Host = ""
+
+	target := Target{Transport: "udp", IP: clientAddr.IP, Port: clientAddr.Port, Listener: "b"}
+	assert.Nil(t, l.SendTo(req, target))
+
+	buf := make([]byte, maxPacketSize)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := client.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, b.String(), from.String())
+	assert.Contains(t, string(buf[:n]), "Via: SIP/2.0/UDP sip.example.com:5080;")
+
+	target.Listener = "missing"
+	assert.ErrorIs(t, l.SendTo(req, target), ErrNoListener)
+
+	// Responses are sent from the socket the request arrived on.
+	_, err = client.WriteTo([]byte(strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1", "SIP/2.0/UDP 127.0.0.1;rport", 1)), b)
+	assert.Nil(t, err)
+
+	msg := <-l.Messages()
+	assert.Equal(t, "b", msg.Listener.Name)
+	assert.Nil(t, l.Send(sip.NewResponse(msg, 200, "OK")))
+
+	n, from, err = client.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, b.String(), from.String())
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "SIP/2.0 200 OK\r\n"))
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// Message is a message received from the network together with information
+// about how it arrived. It embeds the parsed message, so it can be used
+// wherever a sip.Message is expected.
+type Message struct {
+	sip.Message
+
+	// Source is the address the message was received from.
+	Source net.Addr
+	// Destination is the local address the message was received on.
+	Destination net.Addr
+	// Transport is the lowercase transport name: "udp", "tcp" or "tls".
+	Transport string
+	// Listener is the listener the message arrived on, or the listener the
+	// connection it arrived on was opened from. It is nil for connections
+	// opened without a listener of their transport. It must not be modified.
+	Listener *Listener
+	// ConnID identifies the connection or socket the message arrived on. It is
+	// unique for the lifetime of the layer.
+	ConnID uint64
+	// RouteFlow is the flow named by the flow token in the top Route or, if
+	// there is no Route, the Request-URI of a request. An edge proxy forwards
+	// the request over it with SendFlow.
+	RouteFlow *Flow
+	// PeerCertificates holds the certificate chain presented by the peer on a
+	// TLS connection.
+	PeerCertificates []*x509.Certificate
+	// ReceivedAt is the time the message was read from the network.
+	ReceivedAt time.Time
+}
+
+// transportName returns the name used in Via header fields for the transport
+// that conn is using.
+func transportName(conn net.Conn) string {
+	if _, ok := conn.(*tls.Conn); ok {
+		return "tls"
+	}
+	return networkName(conn.LocalAddr().Network())
+}
+
+// networkName strips the address family from a network name.
+func networkName(network string) string {
+	return strings.TrimRight(network, "46")
+}
+
+// peerCertificates returns the certificates presented by the peer of a TLS
+// connection.
+func peerCertificates(conn net.Conn) []*x509.Certificate {
+	if tc, ok := conn.(*tls.Conn); ok {
+		return tc.ConnectionState().PeerCertificates
+	}
+	return nil
+}
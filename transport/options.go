@@ -0,0 +1,249 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a received message when the inbound
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the reader wait until there is room in the queue.
+	// This stalls the connection or socket the message arrived on.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop discards the newest message.
+	OverflowDrop
+	// OverflowReject discards the newest message and answers requests with
+	// 503 Service Unavailable and a Retry-After header field.
+	OverflowReject
+)
+
+// Handler processes a received message.
+type Handler func(msg *Message)
+
+// Option configures a layer created by NewLayer.
+type Option func(*options)
+
+type options struct {
+	queueSize  int
+	overflow   OverflowPolicy
+	retryAfter time.Duration
+	workers    int
+	handler    Handler
+
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+	flowFailed        func(flow Flow, err error)
+
+	resolver Resolver
+
+	tcpSwitch   bool
+	mtu         int
+	dialTimeout time.Duration
+
+	rateLimit *RateLimit
+	acl       *ACL
+}
+
+func defaultOptions() options {
+	return options{
+		overflow:         OverflowBlock,
+		retryAfter:       5 * time.Second,
+		keepAliveTimeout: 10 * time.Second,
+		tcpSwitch:        true,
+		dialTimeout:      4 * time.Second,
+	}
+}
+
+// WithResolver sets the resolver used to locate the servers requests are sent
+// to. The default queries the nameserver from /etc/resolv.conf.
+func WithResolver(r Resolver) Option {
+	return func(o *options) {
+		o.resolver = r
+	}
+}
+
+// WithQueueSize sets the number of received messages that can be waiting for
+// the consumer. The default is zero, which hands every message directly to the
+// consumer.
+func WithQueueSize(size int) Option {
+	return func(o *options) {
+		o.queueSize = size
+	}
+}
+
+// WithOverflowPolicy sets what happens when the queue is full.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(o *options) {
+		o.overflow = policy
+	}
+}
+
+// WithRetryAfter sets the Retry-After value sent with 503 responses when the
+// overflow policy is OverflowReject.
+func WithRetryAfter(d time.Duration) Option {
+	return func(o *options) {
+		o.retryAfter = d
+	}
+}
+
+// WithHandler dispatches received messages to handler on the given number of
+// worker goroutines. The Messages channel is consumed by the workers and must
+// not be read when a handler is set.
+func WithHandler(workers int, handler Handler) Option {
+	return func(o *options) {
+		if workers < 1 {
+			workers = 1
+		}
+		o.workers = workers
+		o.handler = handler
+	}
+}
+
+// WithKeepAlive enables CRLF keepalives on the connections the layer opens.
+// A ping is sent every interval and the flow fails if the pong does not arrive
+// within timeout. RFC 5626 recommends an interval of 95 to 120 seconds and a
+// timeout of 10 seconds.
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return func(o *options) {
+		o.keepAliveInterval = interval
+		o.keepAliveTimeout = timeout
+	}
+}
+
+// WithFlowFailed sets a function that is called when a flow stops answering
+// keepalives, so that registrations over it can be refreshed.
+func WithFlowFailed(fn func(flow Flow, err error)) Option {
+	return func(o *options) {
+		o.flowFailed = fn
+	}
+}
+
+// WithTCPSwitch enables or disables sending large requests for UDP targets
+// over TCP. It is enabled by default.
+func WithTCPSwitch(enabled bool) Option {
+	return func(o *options) {
+		o.tcpSwitch = enabled
+	}
+}
+
+// WithDialTimeout sets how long the layer waits for the connections it opens
+// to send a message, such as a large request for a UDP target that is sent
+// over TCP. Requests fall back to UDP when the connection cannot be opened in
+// time, so the timeout has to stay well below Timer B. The default is 4
+// seconds, and zero waits as long as the operating system does.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithRateLimit limits the rate at which each source may send messages.
+func WithRateLimit(limit RateLimit) Option {
+	return func(o *options) {
+		o.rateLimit = &limit
+	}
+}
+
+// WithACL sets the initial access control list. It can be replaced while
+// the layer runs with SetACL.
+func WithACL(acl ACL) Option {
+	return func(o *options) {
+		o.acl = &acl
+	}
+}
+
+// WithPathMTU sets the path MTU used to decide whether a request is too large
+// for UDP. When it is not set requests larger than 1300 bytes are too large.
+func WithPathMTU(mtu int) Option {
+	return func(o *options) {
+		o.mtu = mtu
+	}
+}
+
+// ListenOption configures a single listener.
+type ListenOption func(*listenOptions)
+
+type listenOptions struct {
+	name      string
+	host      string
+	port      int
+	internal  bool
+	tlsConfig *tls.Config
+
+	proxy   bool
+	trusted []netip.Prefix
+
+	err error
+}
+
+// WithName sets the name that selects the listener in Target.Listener.
+func WithName(name string) ListenOption {
+	return func(o *listenOptions) {
+		o.name = name
+	}
+}
+
+// WithAdvertised sets the host and port advertised in the Via of requests
+// sent from the listener and in its Record-Route URI, for listeners behind a
+// NAT or load balancer. A zero port advertises the bound port.
+func WithAdvertised(host string, port int) ListenOption {
+	return func(o *listenOptions) {
+		o.host = host
+		o.port = port
+	}
+}
+
+// WithInternal marks the listener as facing the internal network, so that it
+// is preferred for requests to private addresses.
+func WithInternal() ListenOption {
+	return func(o *listenOptions) {
+		o.internal = true
+	}
+}
+
+// WithTLSConfig sets the configuration of a "tls" listener. Connections the
+// layer opens from the listener use it as the client configuration.
+func WithTLSConfig(config *tls.Config) ListenOption {
+	return func(o *listenOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// WithProxyProtocol makes a stream listener read the PROXY protocol header
+// that load balancers send at the start of a connection, and use the client
+// address it carries as the source of the messages. Only the peers whose
+// address matches one of the trusted IP addresses or CIDR prefixes may send a
+// header; other peers are served with their own address. When no trusted
+// address is given every peer must send a header.
+func WithProxyProtocol(trusted ...string) ListenOption {
+	return func(o *listenOptions) {
+		o.proxy = true
+		for _, s := range trusted {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				o.err = err
+				return
+			}
+			o.trusted = append(o.trusted, prefix)
+		}
+	}
+}
+
+// parsePrefix parses a CIDR prefix or a single IP address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
@@ -0,0 +1,323 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time a trusted peer has to send the PROXY
+// protocol header after connecting.
+const proxyHeaderTimeout = 5 * time.Second
+
+// maxProxyV1Length is the longest version 1 header, including the CRLF.
+const maxProxyV1Length = 107
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyListener reads the PROXY protocol header that a load balancer sends at
+// the start of every connection, and reports the client address it carries as
+// the remote address of the connection. Headers are read in a goroutine per
+// connection so that a slow peer cannot stall Accept.
+//
+// See: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+type proxyListener struct {
+	net.Listener
+
+	// trusted holds the addresses allowed to send a header. Connections from
+	// other addresses are served with their own address. When it is empty
+	// every peer must send a header.
+	trusted []netip.Prefix
+	hooks   proxyHooks
+
+	conns     chan net.Conn
+	err       chan error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// pending holds the connections whose header is being read, so that
+	// Close can abort the handshakes.
+	mu      sync.Mutex
+	pending map[net.Conn]struct{}
+}
+
+// proxyHooks tie the handshakes of a proxyListener to the layer serving it.
+type proxyHooks struct {
+	// begin is called before a handshake starts and returns false if the
+	// connection must be closed instead. end is called when it has finished.
+	begin func() bool
+	end   func()
+	// onError is called for connections closed because of an invalid header.
+	onError func(addr net.Addr, err error)
+}
+
+func newProxyListener(listener net.Listener, trusted []netip.Prefix, hooks proxyHooks) *proxyListener {
+	pl := &proxyListener{
+		Listener: listener,
+		trusted:  trusted,
+		hooks:    hooks,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+		pending:  map[net.Conn]struct{}{},
+	}
+	go pl.accept()
+	return pl
+}
+
+func (pl *proxyListener) accept() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			pl.err <- err
+			return
+		}
+		if !pl.addPending(conn) {
+			conn.Close()
+			continue
+		}
+		go pl.handshake(conn)
+	}
+}
+
+// addPending registers a connection whose handshake is about to start. It
+// returns false once the listener or the layer is closing.
+func (pl *proxyListener) addPending(conn net.Conn) bool {
+	// The layer calls Close with its lock held, so begin must not be called
+	// with pl.mu held.
+	if !pl.hooks.begin() {
+		return false
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	select {
+	case <-pl.done:
+		pl.hooks.end()
+		return false
+	default:
+	}
+	pl.pending[conn] = struct{}{}
+	return true
+}
+
+func (pl *proxyListener) handshake(conn net.Conn) {
+	defer pl.hooks.end()
+
+	raw := conn
+	if pl.isTrusted(conn.RemoteAddr()) {
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			pl.removePending(raw)
+			conn.Close()
+			pl.hooks.onError(conn.RemoteAddr(), err)
+			return
+		}
+		conn = pc
+	}
+	if !pl.removePending(raw) {
+		// Close has closed the connection.
+		return
+	}
+
+	select {
+	case pl.conns <- conn:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *proxyListener) isTrusted(addr net.Addr) bool {
+	if len(pl.trusted) == 0 {
+		return true
+	}
+
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcp.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range pl.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.err:
+		// Keep returning the error to later calls.
+		pl.err <- err
+		return nil, err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// removePending unregisters a connection whose handshake has finished. It
+// returns false if Close has already closed it.
+func (pl *proxyListener) removePending(conn net.Conn) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	_, ok := pl.pending[conn]
+	delete(pl.pending, conn)
+	return ok
+}
+
+// Close stops accepting connections and closes the connections whose header
+// has not been read yet.
+func (pl *proxyListener) Close() error {
+	pl.closeOnce.Do(func() {
+		pl.mu.Lock()
+		close(pl.done)
+		for conn := range pl.pending {
+			conn.Close()
+		}
+		clear(pl.pending)
+		pl.mu.Unlock()
+	})
+	return pl.Listener.Close()
+}
+
+// proxyConn is a connection whose remote address was taken from a PROXY
+// protocol header. Reads continue from the data buffered after the header.
+type proxyConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads a version 1 or 2 header from conn. The connection's
+// own address is kept when the header does not carry a TCP client address,
+// as for health checks sent with the LOCAL command.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, reader: reader, remote: conn.RemoteAddr()}
+
+	sig, err := reader.Peek(len(proxyV1Signature))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+
+	var addr net.Addr
+	if bytes.Equal(sig, proxyV1Signature) {
+		addr, err = readProxyV1(reader)
+	} else {
+		addr, err = readProxyV2(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		pc.remote = addr
+	}
+	return pc, nil
+}
+
+// readProxyV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5060\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	if len(line) > maxProxyV1Length || !bytes.HasSuffix(line, crlf) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, ErrInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// Only TCP over IPv4 and IPv6 carry a client address we can use. The
+	// TLVs after the addresses are ignored.
+	switch header[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		port := binary.BigEndian.Uint16(body[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16]))
+		port := binary.BigEndian.Uint16(body[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+	}
+	return nil, nil
+}
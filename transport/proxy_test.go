@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	b := append([]byte(nil), proxyV2Signature...)
+	b = append(b, 0x20|cmd, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x13, 0xc4}
+	ipv6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	ipv6 = append(ipv6, 0xdc, 0x04, 0x13, 0xc4)
+
+	tests := []struct {
+		Header string
+		Remote string
+		Err    error
+	}{
+		{Header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5060\r\n", Remote: "192.0.2.1:56324"},
+		{Header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 5060\r\n", Remote: "[2001:db8::1]:56324"},
+		{Header: "PROXY UNKNOWN\r\n", Remote: "pipe"},
+		{Header: string(proxyV2Header(0x1, 0x11, ipv4)), Remote: "192.0.2.1:56324"},
+		{Header: string(proxyV2Header(0x1, 0x21, ipv6)), Remote: "[2001:db8::1]:56324"},
+		{Header: string(proxyV2Header(0x0, 0x00, nil)), Remote: "pipe"},
+		{Header: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 5060\r\n", Err: ErrInvalidProxyHeader},
+		{Header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", Err: ErrInvalidProxyHeader},
+		{Header: string(proxyV2Header(0x1, 0x11, ipv4[:8])), Err: ErrInvalidProxyHeader},
+		{Header: "OPTIONS sip:bob@biloxi.com SIP/2.0\r\n", Err: ErrInvalidProxyHeader},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go func() {
+			client.Write([]byte(test.Header + "rest"))
+			client.Close()
+		}()
+
+		pc, err := readProxyHeader(server)
+		if test.Err != nil {
+			assert.ErrorIs(t, err, test.Err, test.Header)
+			server.Close()
+			continue
+		}
+		assert.Nil(t, err, test.Header)
+		assert.Equal(t, test.Remote, pc.RemoteAddr().String(), test.Header)
+
+		rest, _ := io.ReadAll(pc)
+		assert.Equal(t, "rest", string(rest), test.Header)
+		server.Close()
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l := NewLayer()
+	defer l.Shutdown(context.Background())
+
+	_, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0", WithProxyProtocol("not an address"))
+	assert.NotNil(t, err)
+
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0", WithProxyProtocol("127.0.0.0/8"))
+	assert.Nil(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 5060\r\n" + testRequest))
+	assert.Nil(t, err)
+
+	select {
+	case msg := <-l.Messages():
+		assert.Equal(t, "192.0.2.1:56324", msg.Source.String())
+		vias, _ := msg.Via()
+		assert.Equal(t, "192.0.2.1", vias[0].Received)
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	// Peers outside the trust list are served with their own address.
+	direct, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0", WithProxyProtocol("192.0.2.0/24"))
+	assert.Nil(t, err)
+
+	client, err = net.Dial("tcp", direct.String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte(testRequest))
+	assert.Nil(t, err)
+
+	select {
+	case msg := <-l.Messages():
+		assert.True(t, strings.HasPrefix(msg.Source.String(), "127.0.0.1:"))
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestProxyProtocolShutdown(t *testing.T) {
+	l := NewLayer()
+
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0", WithProxyProtocol())
+	assert.Nil(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Eventually(t, func() bool {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		for listener := range l.listeners {
+			pl := listener.(*proxyListener)
+			pl.mu.Lock()
+			defer pl.mu.Unlock()
+			return len(pl.pending) == 1
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	// Shutdown closes the connection whose header is pending instead of
+	// waiting for it to time out.
+	start := time.Now()
+	assert.Nil(t, l.Shutdown(context.Background()))
+	assert.Less(t, time.Since(start), proxyHeaderTimeout)
+
+	// A header sent after Shutdown must not be reported.
+	client.Write([]byte("garbage\r\n"))
+	time.Sleep(10 * time.Millisecond)
+}
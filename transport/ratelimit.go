@@ -0,0 +1,253 @@
+package transport
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// RateKey selects what a rate limit is kept for, in addition to the source IP
+// address.
+type RateKey int
+
+const (
+	// RateKeyIP keeps one limit per source IP address.
+	RateKeyIP RateKey = iota
+	// RateKeyMethod keeps one limit per source IP address and request method.
+	RateKeyMethod
+	// RateKeyFromUser keeps one limit per source IP address and user part of
+	// the From URI.
+	RateKeyFromUser
+)
+
+// rateSweepInterval is how often idle buckets and expired bans are removed.
+const rateSweepInterval = time.Minute
+
+// RateLimit configures the token buckets that limit the messages a source may
+// send. Messages over the limit are dropped without an answer, since answering
+// a flood would amplify it.
+type RateLimit struct {
+	// Rate is the number of messages per second a source may send on average,
+	// and Burst the number it may send at once.
+	Rate  float64
+	Burst int
+	// Key selects what the limit is kept for. Limits other than per IP
+	// address, and limits restricted to some methods, are applied after the
+	// message has been parsed; others are applied before.
+	Key RateKey
+	// Methods restricts the limit to requests with these methods, such as
+	// INVITE and REGISTER. When it is empty every message is limited.
+	Methods []string
+	// A source that exceeds the limit BanAfter times within BanDuration is
+	// banned for BanDuration: all its messages are dropped and its
+	// connections closed. Zero disables bans.
+	BanAfter    int
+	BanDuration time.Duration
+	// Allow lists the sources that are never limited.
+	Allow []netip.Prefix
+}
+
+// preParse reports whether the limit can be applied to raw messages.
+func (rl RateLimit) preParse() bool {
+	return rl.Key == RateKeyIP && len(rl.Methods) == 0
+}
+
+type rateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	offenders map[netip.Addr]*offender
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// offender tracks the violations of a source and its ban.
+type offender struct {
+	violations  int
+	firstAt     time.Time
+	bannedUntil time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		now:       time.Now,
+		buckets:   map[string]*bucket{},
+		offenders: map[netip.Addr]*offender{},
+	}
+}
+
+func (r *rateLimiter) allowed(ip netip.Addr) bool {
+	for _, prefix := range r.limit.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// banned reports whether ip is currently banned.
+func (r *rateLimiter) banned(ip netip.Addr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.offenders[ip]
+	return ok && r.now().Before(o.bannedUntil)
+}
+
+// take removes a token from the bucket for key. When the bucket is empty it
+// counts a violation against ip and reports whether that got ip banned.
+func (r *rateLimiter) take(ip netip.Addr, key string) (ok, ban bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+
+	b, found := r.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(r.limit.Burst), last: now}
+		r.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.limit.Rate
+	if burst := float64(r.limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+
+	if r.limit.BanAfter <= 0 {
+		return false, false
+	}
+
+	o, found := r.offenders[ip]
+	if !found || now.Sub(o.firstAt) > r.limit.BanDuration {
+		o = &offender{firstAt: now}
+		r.offenders[ip] = o
+	}
+	o.violations++
+	if o.violations >= r.limit.BanAfter && !now.Before(o.bannedUntil) {
+		o.bannedUntil = now.Add(r.limit.BanDuration)
+		o.violations = 0
+		o.firstAt = now
+		return false, true
+	}
+	return false, false
+}
+
+// sweep removes full buckets and expired offenders so that the tables do not
+// grow with every source ever seen. It must be called with r.mu held.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateSweepInterval {
+		return
+	}
+	r.lastSweep = now
+
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.limit.Rate >= float64(r.limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+	for ip, o := range r.offenders {
+		if now.After(o.bannedUntil) && now.Sub(o.firstAt) > r.limit.BanDuration {
+			delete(r.offenders, ip)
+		}
+	}
+}
+
+// admitSource decides whether a connection or raw message from addr is
+// processed: sources that are banned are not, and when the limit is per IP
+// address the message takes a token before it is parsed.
+func (l *layer) admitSource(addr net.Addr, message bool) bool {
+	r := l.limiter
+	if r == nil {
+		return true
+	}
+
+	ip := addrPort(addr).Addr()
+	if r.allowed(ip) {
+		return true
+	}
+	if r.banned(ip) {
+		l.counters.rateLimited.Add(1)
+		return false
+	}
+	if !message || !r.limit.preParse() {
+		return true
+	}
+	return l.take(ip, ip.String())
+}
+
+// admitMessage applies the limits that need the parsed message.
+func (l *layer) admitMessage(addr net.Addr, msg sip.Message) bool {
+	r := l.limiter
+	if r == nil || r.limit.preParse() {
+		return true
+	}
+
+	ip := addrPort(addr).Addr()
+	if r.allowed(ip) {
+		return true
+	}
+
+	if len(r.limit.Methods) > 0 {
+		limited := false
+		for _, method := range r.limit.Methods {
+			if msg.Method() == method {
+				limited = true
+				break
+			}
+		}
+		if !limited {
+			return true
+		}
+	}
+
+	key := ip.String()
+	switch r.limit.Key {
+	case RateKeyMethod:
+		key += " " + msg.Method()
+	case RateKeyFromUser:
+		if from, ok := msg.From(); ok {
+			key += " " + from.User
+		}
+	}
+	return l.take(ip, key)
+}
+
+func (l *layer) take(ip netip.Addr, key string) bool {
+	ok, ban := l.limiter.take(ip, key)
+	if !ok {
+		l.counters.rateLimited.Add(1)
+	}
+	if ban {
+		l.counters.banned.Add(1)
+		l.closeConnsFrom(ip)
+	}
+	return ok
+}
+
+// closeConnsFrom closes the stream connections from a banned source.
+func (l *layer) closeConnsFrom(ip netip.Addr) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, s := range l.conns {
+		if addrPort(s.RemoteAddr()).Addr() == ip {
+			s.Close()
+		}
+	}
+}
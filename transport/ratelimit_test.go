@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	r := newRateLimiter(RateLimit{Rate: 1, Burst: 2, BanAfter: 3, BanDuration: 10 * time.Second})
+	r.now = func() time.Time { return now }
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	take := func() bool {
+		ok, _ := r.take(ip, ip.String())
+		return ok
+	}
+
+	assert.True(t, take())
+	assert.True(t, take())
+	assert.False(t, take())
+
+	now = now.Add(time.Second)
+	assert.True(t, take())
+	assert.False(t, take())
+	assert.False(t, r.banned(ip))
+
+	// The third violation within the ban duration bans the source.
+	_, ban := r.take(ip, ip.String())
+	assert.True(t, ban)
+	assert.True(t, r.banned(ip))
+	assert.False(t, r.banned(netip.MustParseAddr("192.0.2.2")))
+
+	now = now.Add(10 * time.Second)
+	assert.False(t, r.banned(ip))
+	assert.True(t, take())
+}
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		Limit     RateLimit
+		Requests  []string
+		Delivered int
+	}{
+		{
+			Limit:     RateLimit{Rate: 0.001, Burst: 2},
+			Requests:  []string{"OPTIONS", "OPTIONS", "OPTIONS"},
+			Delivered: 2,
+		},
+		{
+			Limit:     RateLimit{Rate: 0.001, Burst: 1, Key: RateKeyMethod, Methods: []string{"INVITE"}},
+			Requests:  []string{"INVITE", "OPTIONS", "INVITE", "OPTIONS"},
+			Delivered: 3,
+		},
+		{
+			Limit:     RateLimit{Rate: 0.001, Burst: 1, Allow: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+			Requests:  []string{"OPTIONS", "OPTIONS"},
+			Delivered: 2,
+		},
+	}
+
+	for _, test := range tests {
+		l := NewLayer(WithQueueSize(len(test.Requests)), WithRateLimit(test.Limit))
+		addr, err := l.Listen(context.Background(), "udp", "127.0.0.1:0")
+		assert.Nil(t, err)
+
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.Nil(t, err)
+
+		for _, method := range test.Requests {
+			req := strings.Replace(testRequest, "SIP/2.0/TCP", "SIP/2.0/UDP", 1)
+			req = strings.ReplaceAll(req, "OPTIONS", method)
+			_, err := client.WriteTo([]byte(req), addr)
+			assert.Nil(t, err)
+		}
+
+		assert.Eventually(t, func() bool {
+			stats := l.Stats()
+			return stats.QueueDepth+int(stats.RateLimited) == len(test.Requests)
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, test.Delivered, l.Stats().QueueDepth)
+
+		client.Close()
+		l.Shutdown(context.Background())
+	}
+}
+
+func TestRateLimitBanClosesConnections(t *testing.T) {
+	l := NewLayer(WithQueueSize(10), WithRateLimit(RateLimit{Rate: 0.001, Burst: 1, BanAfter: 1, BanDuration: time.Minute}))
+	defer l.Shutdown(context.Background())
+
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte(testRequest + testRequest))
+	assert.Nil(t, err)
+
+	// The connection is closed and new connections are refused.
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, uint64(1), l.Stats().Banned)
+
+	client, err = net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+}
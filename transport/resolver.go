@@ -0,0 +1,362 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+var ErrNoTargets = errors.New("transport: no targets found")
+
+// Target is a transport, address and port to send a request to.
+type Target struct {
+	Transport string
+	// Host is the domain the target was resolved from. It is the expected
+	// server name of TLS targets.
+	Host string
+	IP   net.IP
+	Port int
+	// Listener is the name of the listener to send from. When it is empty a
+	// listener is chosen by address family and network, see Listener.
+	Listener string
+	// Flow is set for a next hop with a flow token of the layer. Requests
+	// for the target are sent over that flow.
+	Flow *Flow
+}
+
+// Addr returns the address of the target in host:port form.
+func (t Target) Addr() string {
+	return net.JoinHostPort(t.IP.String(), strconv.Itoa(t.Port))
+}
+
+// Resolver locates the servers that a request for uri should be sent to. The
+// targets are returned in the order they should be tried.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3263#section-4
+type Resolver interface {
+	Resolve(ctx context.Context, uri sip.URI) ([]Target, error)
+}
+
+// transportServices maps NAPTR services and SRV prefixes to transports in the
+// order of preference used when there are no NAPTR records.
+var transportServices = []struct {
+	transport string
+	naptr     string
+	srv       string
+	secure    bool
+}{
+	{transport: "tls", naptr: "SIPS+D2T", srv: "_sips._tcp.", secure: true},
+	{transport: "tcp", naptr: "SIP+D2T", srv: "_sip._tcp."},
+	{transport: "udp", naptr: "SIP+D2U", srv: "_sip._udp."},
+}
+
+func defaultTransport(uri sip.URI) string {
+	if uri.Transport != "" {
+		if uri.Scheme == "sips" && uri.Transport == "tcp" {
+			return "tls"
+		}
+		return uri.Transport
+	}
+	if uri.Scheme == "sips" {
+		return "tls"
+	}
+	return "udp"
+}
+
+func defaultPortFor(transport string) int {
+	if transport == "tls" {
+		return 5061
+	}
+	return 5060
+}
+
+// targetHost returns the host to resolve for uri, which is maddr if present.
+func targetHost(uri sip.URI) string {
+	if uri.Maddr != "" {
+		return uri.Maddr
+	}
+	return uri.Host
+}
+
+// Resolve implements Resolver.
+//
+// The transport is taken from the transport parameter, or selected with NAPTR
+// records and then SRV records when the host is a domain name without a port.
+// SRV targets are ordered by priority and, within a priority, randomly by
+// weight. Without SRV records the A and AAAA records of the host are used with
+// the default port. A NAPTR or SRV query that fails is treated as returning no
+// records, so that resolution falls through to the next step.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3263#section-4.1
+// See: https://datatracker.ietf.org/doc/html/rfc3263#section-4.2
+func (r *DNSResolver) Resolve(ctx context.Context, uri sip.URI) ([]Target, error) {
+	host := targetHost(uri)
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []Target{numericTarget(uri, ip)}, nil
+	}
+
+	if uri.Port != "" {
+		port, err := strconv.Atoi(uri.Port)
+		if err != nil {
+			return nil, err
+		}
+		return r.addressTargets(ctx, defaultTransport(uri), host, host, port)
+	}
+
+	var targets []Target
+	for _, service := range r.services(ctx, uri, host) {
+		records, err := r.lookupSRV(ctx, service.name)
+		if err != nil {
+			continue
+		}
+		for _, record := range orderSRV(records) {
+			// A target of "." means that the service is not available.
+			if record.target == "" || record.target == "." {
+				continue
+			}
+			resolved, err := r.addressTargets(ctx, service.transport, host, record.target, int(record.port))
+			if err != nil {
+				continue
+			}
+			targets = append(targets, resolved...)
+		}
+	}
+	if len(targets) > 0 {
+		return targets, nil
+	}
+
+	transport := defaultTransport(uri)
+	return r.addressTargets(ctx, transport, host, host, defaultPortFor(transport))
+}
+
+type srvService struct {
+	transport string
+	name      string
+}
+
+// services returns the SRV names to query for host, from its NAPTR records if
+// there are any, and otherwise for every transport that can be used.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3263#section-4.1
+func (r *DNSResolver) services(ctx context.Context, uri sip.URI, host string) []srvService {
+	naptrs, _ := r.lookupNAPTR(ctx, host)
+
+	sort.SliceStable(naptrs, func(i, j int) bool {
+		if naptrs[i].order != naptrs[j].order {
+			return naptrs[i].order < naptrs[j].order
+		}
+		return naptrs[i].preference < naptrs[j].preference
+	})
+
+	var services []srvService
+	for _, naptr := range naptrs {
+		if !strings.EqualFold(naptr.flags, "s") {
+			continue
+		}
+		for _, ts := range transportServices {
+			if !strings.EqualFold(naptr.service, ts.naptr) || !transportAllowed(uri, ts.transport, ts.secure) {
+				continue
+			}
+			services = append(services, srvService{transport: ts.transport, name: naptr.replacement})
+		}
+	}
+	if len(services) > 0 {
+		return services
+	}
+
+	for _, ts := range transportServices {
+		if transportAllowed(uri, ts.transport, ts.secure) {
+			services = append(services, srvService{transport: ts.transport, name: ts.srv + host})
+		}
+	}
+	return services
+}
+
+// transportAllowed reports whether a transport may be used for uri. SIPS URIs
+// require TLS, and an explicit transport parameter restricts the choice.
+func transportAllowed(uri sip.URI, transport string, secure bool) bool {
+	if uri.Scheme == "sips" && !secure {
+		return false
+	}
+	if uri.Transport != "" {
+		return defaultTransport(uri) == transport
+	}
+	return true
+}
+
+func (r *DNSResolver) addressTargets(ctx context.Context, transport, domain, host string, port int) ([]Target, error) {
+	ips, err := r.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, len(ips))
+	for _, ip := range ips {
+		targets = append(targets, Target{Transport: transport, Host: domain, IP: ip, Port: port})
+	}
+	return targets, nil
+}
+
+func numericTarget(uri sip.URI, ip net.IP) Target {
+	transport := defaultTransport(uri)
+	port := defaultPortFor(transport)
+	if p, err := strconv.Atoi(uri.Port); err == nil {
+		port = p
+	}
+	return Target{Transport: transport, Host: uri.Host, IP: ip, Port: port}
+}
+
+// orderSRV sorts SRV records by priority and orders records of the same
+// priority randomly, with the probability of coming first proportional to
+// their weight.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc2782
+func orderSRV(records []dnsRecord) []dnsRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].priority < records[j].priority
+	})
+
+	ordered := make([]dnsRecord, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].priority == records[start].priority {
+			end++
+		}
+
+		group := append([]dnsRecord(nil), records[start:end]...)
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += int(record.weight)
+			}
+
+			i := 0
+			if total > 0 {
+				n := rand.Intn(total + 1)
+				for sum := 0; i < len(group)-1; i++ {
+					if sum += int(group[i].weight); sum >= n {
+						break
+					}
+				}
+			}
+
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+// StaticResolver resolves hosts from a fixed table, for example one loaded
+// from a hosts file. Targets without a transport or port get the defaults for
+// the URI being resolved.
+type StaticResolver struct {
+	mu    sync.RWMutex
+	hosts map[string][]Target
+}
+
+func NewStaticResolver() *StaticResolver {
+	return &StaticResolver{hosts: map[string][]Target{}}
+}
+
+// NewHostsResolver creates a static resolver from a file in the format of
+// /etc/hosts.
+func NewHostsResolver(path string) (*StaticResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := NewStaticResolver()
+	if err := r.LoadHosts(f); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Add appends targets for host.
+func (r *StaticResolver) Add(host string, targets ...Target) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	host = strings.ToLower(host)
+	r.hosts[host] = append(r.hosts[host], targets...)
+}
+
+// LoadHosts adds the entries of a hosts file, where every line holds an
+// address followed by the names that resolve to it.
+func (r *StaticResolver) LoadHosts(rd io.Reader) error {
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			r.Add(name, Target{IP: ip})
+		}
+	}
+	return scanner.Err()
+}
+
+// Resolve implements Resolver.
+func (r *StaticResolver) Resolve(ctx context.Context, uri sip.URI) ([]Target, error) {
+	host := targetHost(uri)
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []Target{numericTarget(uri, ip)}, nil
+	}
+
+	r.mu.RLock()
+	entries := r.hosts[strings.ToLower(host)]
+	r.mu.RUnlock()
+
+	transport := defaultTransport(uri)
+	port := 0
+	if p, err := strconv.Atoi(uri.Port); err == nil {
+		port = p
+	}
+
+	var targets []Target
+	for _, entry := range entries {
+		if entry.Transport == "" {
+			entry.Transport = transport
+		}
+		if !transportAllowed(uri, entry.Transport, entry.Transport == "tls") {
+			continue
+		}
+		if port != 0 {
+			entry.Port = port
+		} else if entry.Port == 0 {
+			entry.Port = defaultPortFor(entry.Transport)
+		}
+		if entry.Host == "" {
+			entry.Host = host
+		}
+		targets = append(targets, entry)
+	}
+
+	if len(targets) == 0 {
+		return nil, ErrNoTargets
+	}
+	return targets, nil
+}
@@ -0,0 +1,379 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dnsStub is an in-process DNS server answering from a fixed set of records.
+// It listens on UDP and TCP on the same port.
+type dnsStub struct {
+	conn     net.PacketConn
+	listener net.Listener
+	records  map[string][]dnsRecord
+
+	mu sync.Mutex
+	// failures holds the questions answered with SERVFAIL.
+	failures map[string]bool
+	// truncate makes UDP responses truncated, so that clients retry over
+	// TCP.
+	truncate bool
+	queries  int
+}
+
+func newDNSStub(t *testing.T, records []dnsRecord) *dnsStub {
+	conn, listener := listenDNSStub(t)
+	t.Cleanup(func() { conn.Close() })
+	t.Cleanup(func() { listener.Close() })
+
+	stub := &dnsStub{
+		conn:     conn,
+		listener: listener,
+		records:  map[string][]dnsRecord{},
+		failures: map[string]bool{},
+	}
+	for _, r := range records {
+		key := stubKey(r.name, r.typ)
+		stub.records[key] = append(stub.records[key], r)
+	}
+
+	go stub.serve()
+	go stub.serveTCP()
+	return stub
+}
+
+// listenDNSStub binds UDP and TCP to the same port. The port the kernel
+// picks for UDP may be taken for TCP, in which case another one is tried.
+func listenDNSStub(t *testing.T) (net.PacketConn, net.Listener) {
+	var err error
+	for i := 0; i < 10; i++ {
+		conn, e := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, e)
+		listener, e := net.Listen("tcp", conn.LocalAddr().String())
+		if e == nil {
+			return conn, listener
+		}
+		conn.Close()
+		err = e
+	}
+	require.NoError(t, err)
+	return nil, nil
+}
+
+func (s *dnsStub) fail(name string, typ uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[stubKey(name, typ)] = true
+}
+
+func (s *dnsStub) setTruncate(truncate bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.truncate = truncate
+}
+
+func (s *dnsStub) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func stubKey(name string, typ uint16) string {
+	return strings.ToLower(name) + "/" + string(rune(typ))
+}
+
+func (s *dnsStub) serve() {
+	buf := make([]byte, dnsMaxSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if res := s.answer(buf[:n], true); res != nil {
+			s.conn.WriteTo(res, addr)
+		}
+	}
+}
+
+func (s *dnsStub) serveTCP() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err == nil {
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err == nil {
+				if res := s.answer(query, false); res != nil {
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(res))), res...))
+				}
+			}
+		}
+		conn.Close()
+	}
+}
+
+func (s *dnsStub) answer(query []byte, udp bool) []byte {
+	name, off, err := readDNSName(query, dnsHeaderSize)
+	if err != nil {
+		return nil
+	}
+	typ := binary.BigEndian.Uint16(query[off : off+2])
+	key := stubKey(name, typ)
+
+	s.mu.Lock()
+	s.queries++
+	failed := s.failures[key]
+	truncated := s.truncate && udp
+	s.mu.Unlock()
+
+	res := append([]byte(nil), query[:off+4]...)
+	switch {
+	case failed:
+		binary.BigEndian.PutUint16(res[2:4], 0x8182)
+	case truncated:
+		binary.BigEndian.PutUint16(res[2:4], 0x8380)
+	default:
+		answers := s.records[key]
+		binary.BigEndian.PutUint16(res[2:4], 0x8180)
+		binary.BigEndian.PutUint16(res[6:8], uint16(len(answers)))
+		for _, r := range answers {
+			res = appendStubRecord(res, r)
+		}
+	}
+	return res
+}
+
+func appendStubRecord(b []byte, r dnsRecord) []byte {
+	var rdata []byte
+	switch r.typ {
+	case dnsTypeA:
+		rdata = r.ip.To4()
+	case dnsTypeAAAA:
+		rdata = r.ip.To16()
+	case dnsTypeSRV:
+		rdata = binary.BigEndian.AppendUint16(rdata, r.priority)
+		rdata = binary.BigEndian.AppendUint16(rdata, r.weight)
+		rdata = binary.BigEndian.AppendUint16(rdata, r.port)
+		rdata = appendDNSName(rdata, r.target)
+	case dnsTypeNAPTR:
+		rdata = binary.BigEndian.AppendUint16(rdata, r.order)
+		rdata = binary.BigEndian.AppendUint16(rdata, r.preference)
+		for _, s := range []string{r.flags, r.service, r.regexp} {
+			rdata = append(rdata, byte(len(s)))
+			rdata = append(rdata, s...)
+		}
+		rdata = appendDNSName(rdata, r.replacement)
+	}
+
+	b = appendDNSName(b, r.name)
+	b = binary.BigEndian.AppendUint16(b, r.typ)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	b = binary.BigEndian.AppendUint32(b, 3600)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+func TestDNSResolverNAPTR(t *testing.T) {
+	stub := newDNSStub(t, []dnsRecord{
+		{name: "example.com", typ: dnsTypeNAPTR, order: 50, preference: 50, flags: "s", service: "SIP+D2U", replacement: "_sip._udp.example.com"},
+		{name: "example.com", typ: dnsTypeNAPTR, order: 90, preference: 50, flags: "s", service: "SIP+D2T", replacement: "_sip._tcp.example.com"},
+		{name: "example.com", typ: dnsTypeNAPTR, order: 10, preference: 50, flags: "s", service: "SIPS+D2T", replacement: "_sips._tcp.example.com"},
+		{name: "_sip._udp.example.com", typ: dnsTypeSRV, priority: 20, weight: 0, port: 5060, target: "backup.example.com"},
+		{name: "_sip._udp.example.com", typ: dnsTypeSRV, priority: 10, weight: 0, port: 5070, target: "primary.example.com"},
+		{name: "_sip._tcp.example.com", typ: dnsTypeSRV, priority: 10, weight: 0, port: 5060, target: "primary.example.com"},
+		{name: "_sips._tcp.example.com", typ: dnsTypeSRV, priority: 10, weight: 0, port: 5061, target: "primary.example.com"},
+		{name: "primary.example.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.1")},
+		{name: "backup.example.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.2")},
+		{name: "backup.example.com", typ: dnsTypeAAAA, ip: net.ParseIP("2001:db8::2")},
+	})
+	r := NewDNSResolver(stub.conn.LocalAddr().String())
+
+	targets, err := r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "example.com"})
+	assert.Nil(t, err)
+
+	var got []string
+	for _, target := range targets {
+		got = append(got, target.Transport+" "+target.Addr())
+	}
+	assert.Equal(t, []string{
+		"tls 192.0.2.1:5061",
+		"udp 192.0.2.1:5070",
+		"udp 192.0.2.2:5060",
+		"udp [2001:db8::2]:5060",
+		"tcp 192.0.2.1:5060",
+	}, got)
+
+	targets, err = r.Resolve(context.Background(), sip.URI{Scheme: "sips", Host: "example.com"})
+	assert.Nil(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "tls", targets[0].Transport)
+	assert.Equal(t, "example.com", targets[0].Host)
+
+	targets, err = r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "example.com", Transport: "tcp"})
+	assert.Nil(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "tcp 192.0.2.1:5060", targets[0].Transport+" "+targets[0].Addr())
+}
+
+func TestDNSResolverFallback(t *testing.T) {
+	stub := newDNSStub(t, []dnsRecord{
+		{name: "_sip._tcp.biloxi.com", typ: dnsTypeSRV, priority: 0, weight: 0, port: 5080, target: "sip.biloxi.com"},
+		{name: "sip.biloxi.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.4")},
+		{name: "atlanta.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.5")},
+	})
+	r := NewDNSResolver(stub.conn.LocalAddr().String())
+
+	targets, err := r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "biloxi.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp 192.0.2.4:5080", targets[0].Transport+" "+targets[0].Addr())
+
+	targets, err = r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "atlanta.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "udp 192.0.2.5:5060", targets[0].Transport+" "+targets[0].Addr())
+
+	targets, err = r.Resolve(context.Background(), sip.URI{Scheme: "sips", Host: "atlanta.com", Port: "5071"})
+	assert.Nil(t, err)
+	assert.Equal(t, "tls 192.0.2.5:5071", targets[0].Transport+" "+targets[0].Addr())
+
+	targets, err = r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "192.0.2.9"})
+	assert.Nil(t, err)
+	assert.Equal(t, "udp 192.0.2.9:5060", targets[0].Transport+" "+targets[0].Addr())
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := orderSRV([]dnsRecord{
+		{priority: 20, target: "c"},
+		{priority: 10, weight: 0, target: "a"},
+		{priority: 10, weight: 65535, target: "b"},
+	})
+	assert.Equal(t, "c", records[2].target)
+	assert.ElementsMatch(t, []string{"a", "b"}, []string{records[0].target, records[1].target})
+}
+
+func TestHostsResolver(t *testing.T) {
+	r := NewStaticResolver()
+	assert.Nil(t, r.LoadHosts(strings.NewReader("# comment\n192.0.2.7 proxy.example.com proxy\n")))
+
+	targets, err := r.Resolve(context.Background(), sip.URI{Scheme: "sips", Host: "proxy"})
+	assert.Nil(t, err)
+	assert.Equal(t, "tls 192.0.2.7:5061", targets[0].Transport+" "+targets[0].Addr())
+
+	_, err = r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "unknown.example.com"})
+	assert.ErrorIs(t, err, ErrNoTargets)
+}
+
+func TestSendRequestFailover(t *testing.T) {
+	server := NewLayer()
+	addr, err := server.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+
+	_, p, _ := net.SplitHostPort(addr.String())
+	port, _ := strconv.Atoi(p)
+
+	// The first target refuses connections.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadAddr := dead.Addr().(*net.TCPAddr)
+	dead.Close()
+
+	resolver := NewStaticResolver()
+	resolver.Add("biloxi.com",
+		Target{Transport: "tcp", IP: deadAddr.IP, Port: deadAddr.Port},
+		Target{Transport: "tcp", IP: net.ParseIP("127.0.0.1"), Port: port},
+	)
+
+	client := NewLayer(WithResolver(resolver))
+	defer client.Shutdown(context.Background())
+
+	req, err := sip.Parse([]byte(strings.Replace(testRequest, "Via: SIP/2.0/TCP 127.0.0.1;", "Via: SIP/2.0/UDP 127.0.0.1;", 1)))
+	assert.Nil(t, err)
+	assert.Nil(t, client.Send(req))
+
+	msg := <-server.Messages()
+	vias, _ := msg.Via()
+	assert.Equal(t, "tcp", vias[0].Transport)
+}
+
+func TestDNSResolverFallsThroughFailures(t *testing.T) {
+	stub := newDNSStub(t, []dnsRecord{
+		{name: "_sip._tcp.biloxi.com", typ: dnsTypeSRV, priority: 0, weight: 0, port: 5080, target: "sip.biloxi.com"},
+		{name: "_sip._udp.biloxi.com", typ: dnsTypeSRV, priority: 0, weight: 0, port: 5060, target: "."},
+		{name: "sip.biloxi.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.4")},
+		{name: "atlanta.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.5")},
+	})
+	stub.fail("biloxi.com", dnsTypeNAPTR)
+	stub.fail("_sips._tcp.biloxi.com", dnsTypeSRV)
+	stub.fail("sip.biloxi.com", dnsTypeAAAA)
+	stub.fail("_sip._udp.atlanta.com", dnsTypeSRV)
+	r := NewDNSResolver(stub.conn.LocalAddr().String())
+
+	// The failed NAPTR and SRV queries are skipped, the "." target is not
+	// used and the failed AAAA query does not discard the A record.
+	targets, err := r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "biloxi.com"})
+	assert.Nil(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, "tcp 192.0.2.4:5080", targets[0].Transport+" "+targets[0].Addr())
+
+	targets, err = r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "atlanta.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "udp 192.0.2.5:5060", targets[0].Transport+" "+targets[0].Addr())
+}
+
+func TestDNSResolverRetriesTruncatedOverTCP(t *testing.T) {
+	stub := newDNSStub(t, []dnsRecord{
+		{name: "atlanta.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.5")},
+	})
+	stub.setTruncate(true)
+	r := NewDNSResolver(stub.conn.LocalAddr().String())
+
+	targets, err := r.Resolve(context.Background(), sip.URI{Scheme: "sip", Host: "atlanta.com", Port: "5060"})
+	assert.Nil(t, err)
+	assert.Equal(t, "udp 192.0.2.5:5060", targets[0].Transport+" "+targets[0].Addr())
+}
+
+func TestDNSResolverCache(t *testing.T) {
+	stub := newDNSStub(t, []dnsRecord{
+		{name: "atlanta.com", typ: dnsTypeA, ip: net.ParseIP("192.0.2.5")},
+	})
+	now := time.Unix(0, 0)
+	r := NewDNSResolver(stub.conn.LocalAddr().String())
+	r.now = func() time.Time { return now }
+
+	uri := sip.URI{Scheme: "sip", Host: "atlanta.com", Port: "5060"}
+	_, err := r.Resolve(context.Background(), uri)
+	assert.Nil(t, err)
+	queries := stub.count()
+	assert.Equal(t, 2, queries)
+
+	// The A record has a TTL of an hour, the empty AAAA answer is cached
+	// for dnsNegativeTTL.
+	now = now.Add(dnsNegativeTTL - time.Second)
+	_, err = r.Resolve(context.Background(), uri)
+	assert.Nil(t, err)
+	assert.Equal(t, queries, stub.count())
+
+	now = now.Add(time.Second)
+	_, err = r.Resolve(context.Background(), uri)
+	assert.Nil(t, err)
+	assert.Equal(t, queries+1, stub.count())
+
+	now = now.Add(time.Hour)
+	_, err = r.Resolve(context.Background(), uri)
+	assert.Nil(t, err)
+	assert.Equal(t, queries+3, stub.count())
+}
@@ -0,0 +1,392 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+const (
+	defaultPort    = "5060"
+	defaultTLSPort = "5061"
+)
+
+// stampVia adds the "received" parameter to the top Via of a request when the
+// sent-by host differs from the source address, and fills in "rport" when the
+// client asked for it.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-18.2.1
+// See: https://datatracker.ietf.org/doc/html/rfc3581#section-4
+func stampVia(msg sip.Message, source net.Addr) {
+	vias, ok := msg.Via()
+	if !ok {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(source.String())
+	if err != nil {
+		return
+	}
+
+	via := vias[0]
+	if via.Host != host || via.RportRequested {
+		via.Received = host
+	}
+	if via.RportRequested {
+		via.Rport = port
+	}
+}
+
+// sendResponse delivers a response according to the top Via.
+//
+// Over reliable transports the response is sent on the connection the request
+// arrived on, or on a new connection to the received address and sent-by port
+// if that connection has been closed. Over unreliable transports the response
+// is sent to maddr if present, otherwise to the received address and rport,
+// and finally to the sent-by address.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-18.2.2
+func (l *layer) sendResponse(via *sip.Via, b []byte) error {
+	host := via.Host
+	if via.Received != "" {
+		host = via.Received
+	}
+
+	switch via.Transport {
+	case "tcp", "tls":
+		if conn := l.origins.get(via); conn != nil {
+			if _, err := conn.Write(b); err == nil {
+				return nil
+			}
+		}
+
+		port := via.Port
+		if port == "" {
+			port = defaultPort
+			if via.Transport == "tls" {
+				port = defaultTLSPort
+			}
+		}
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return err
+		}
+		target := Target{Transport: via.Transport, Host: via.Host, IP: addr.IP, Port: addr.Port}
+
+		conn := l.connTo(target.Addr())
+		if conn == nil {
+			ln := l.listenerFor(target.Transport, target.IP, "")
+			if conn, err = l.dialTarget(context.Background(), target, ln); err != nil {
+				return err
+			}
+		}
+
+		_, err = conn.Write(b)
+		return err
+	}
+
+	port := via.Port
+	if via.Maddr != "" {
+		host = via.Maddr
+	} else if via.Received != "" && via.Rport != "" {
+		port = via.Rport
+	}
+	if port == "" {
+		port = defaultPort
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+
+	// Answer from the socket the peer sent to, so that the response passes
+	// the NAT bindings and firewall pinholes the request opened.
+	conn := l.peers.get(addr)
+	if conn == nil {
+		conn = l.socketFor(addr.IP, "")
+	}
+	if conn == nil {
+		return ErrNoListener
+	}
+
+	_, err = conn.WriteTo(b, addr)
+	return err
+}
+
+const (
+	// maxOrigins bounds the number of requests remembered by an originTable.
+	maxOrigins = 65536
+	// originTTL is how long the connection of a request is remembered. It
+	// outlasts the transactions that may respond to the request.
+	originTTL = 5 * time.Minute
+)
+
+// originTable remembers the stream connection each request arrived on, by
+// its top Via, so that responses are sent back over that connection.
+type originTable struct {
+	mu      sync.Mutex
+	origins map[string]originEntry
+}
+
+type originEntry struct {
+	conn *stream
+	seen time.Time
+}
+
+func (t *originTable) add(via *sip.Via, conn *stream, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.origins == nil {
+		t.origins = map[string]originEntry{}
+	}
+
+	key := via.String()
+	if _, ok := t.origins[key]; !ok && len(t.origins) >= maxOrigins {
+		for k, e := range t.origins {
+			if now.Sub(e.seen) > originTTL || isClosed(e.conn) {
+				delete(t.origins, k)
+			}
+		}
+		if len(t.origins) >= maxOrigins {
+			return
+		}
+	}
+	t.origins[key] = originEntry{conn: conn, seen: now}
+}
+
+// get returns the connection a request with the top Via of a response arrived
+// on, or nil if that connection has been closed.
+func (t *originTable) get(via *sip.Via) *stream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.origins[via.String()]
+	if !ok || isClosed(e.conn) {
+		return nil
+	}
+	return e.conn
+}
+
+// remove forgets the requests of a closed connection.
+func (t *originTable) remove(conn *stream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, e := range t.origins {
+		if e.conn == conn {
+			delete(t.origins, k)
+		}
+	}
+}
+
+func isClosed(conn *stream) bool {
+	select {
+	case <-conn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextHop returns the URI that determines where a request is sent: the top
+// Route if there is one, and otherwise the Request-URI.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-8.1.2
+func nextHop(msg sip.Message) (sip.URI, error) {
+	if route, ok := msg.Route(); ok {
+		first, _, _ := strings.Cut(string(*route), ",")
+		return sip.ParseURI(first)
+	}
+	return msg.RequestURI(), nil
+}
+
+// Resolve implements Layer.
+func (l *layer) Resolve(ctx context.Context, uri sip.URI) ([]Target, error) {
+	return l.opts.resolver.Resolve(ctx, uri)
+}
+
+// Locate implements Layer. A next hop with a flow token of this layer has a
+// single target, which holds the flow.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5626#section-5.3
+func (l *layer) Locate(ctx context.Context, msg sip.Message) ([]Target, error) {
+	uri, err := nextHop(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if flow, ok, err := l.uriFlow(uri); ok {
+		if err != nil {
+			return nil, err
+		}
+		ap := addrPort(flow.RemoteAddr)
+		return []Target{{
+			Transport: flow.Transport,
+			IP:        ap.Addr().AsSlice(),
+			Port:      int(ap.Port()),
+			Flow:      &flow,
+		}}, nil
+	}
+
+	targets, err := l.Resolve(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, ErrNoTargets
+	}
+	return targets, nil
+}
+
+// sendRequest sends msg to the targets located for its next hop in order,
+// until one of them accepts it.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3263#section-4.3
+func (l *layer) sendRequest(ctx context.Context, msg sip.Message) error {
+	targets, err := l.Locate(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		if err = l.SendTo(msg, target); err == nil {
+			return nil
+		}
+		l.reportError(ErrorKindWrite, target.Transport, nil, err)
+	}
+	return err
+}
+
+// SendTo implements Layer. The transport and, if it is empty, the sent-by
+// address of the top Via are set to match the target. The sent-by address is
+// the advertised address of the listener the request is sent from. A target
+// with a flow is sent over the flow.
+//
+// A request for a UDP target that is too large for the path MTU is sent over
+// TCP to the same address instead, and over UDP if the TCP connection cannot be
+// established.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-18.1.1
+func (l *layer) SendTo(msg sip.Message, target Target) error {
+	if target.Flow != nil {
+		return l.SendFlow(msg, *target.Flow)
+	}
+
+	vias, ok := msg.Via()
+	if !ok {
+		return ErrNoVia
+	}
+	via := vias[0]
+
+	if target.Transport == "udp" && l.opts.tcpSwitch {
+		via.Transport = "tcp"
+		if len(msg.String()) > l.udpSizeLimit() {
+			tcp := target
+			tcp.Transport = "tcp"
+			if err := l.sendStream(msg, via, tcp); err == nil {
+				return nil
+			}
+		}
+	}
+
+	via.Transport = target.Transport
+
+	switch target.Transport {
+	case "tcp", "tls":
+		return l.sendStream(msg, via, target)
+	}
+
+	conn := l.socketFor(target.IP, target.Listener)
+	if conn == nil {
+		return ErrNoListener
+	}
+	host, port := conn.listener.sentBy(conn.LocalAddr())
+	setSentBy(via, host, port)
+
+	_, err := conn.WriteTo([]byte(msg.String()), &net.UDPAddr{IP: target.IP, Port: target.Port})
+	return err
+}
+
+// udpSizeLimit is the largest request that may be sent over UDP: 200 bytes
+// below the path MTU, or 1300 bytes when the MTU is unknown.
+func (l *layer) udpSizeLimit() int {
+	if l.opts.mtu > 0 {
+		return l.opts.mtu - 200
+	}
+	return 1300
+}
+
+func (l *layer) sendStream(msg sip.Message, via *sip.Via, target Target) error {
+	conn := l.connTo(target.Addr())
+	if conn == nil && target.Transport == "tls" {
+		conn = l.aliasTo(target)
+	}
+	if conn == nil {
+		ln := l.listenerFor(target.Transport, target.IP, target.Listener)
+		if ln == nil && target.Listener != "" {
+			return ErrNoListener
+		}
+
+		var err error
+		if conn, err = l.dialTarget(context.Background(), target, ln); err != nil {
+			return err
+		}
+	}
+	host, port := conn.listener.sentBy(conn.LocalAddr())
+	setSentBy(via, host, port)
+
+	_, err := conn.Write([]byte(msg.String()))
+	return err
+}
+
+// dialTarget opens a connection to target from ln, giving up after the dial
+// timeout. TLS connections use the configuration of ln, if any, to present a
+// client certificate.
+func (l *layer) dialTarget(ctx context.Context, target Target, ln *Listener) (*stream, error) {
+	if l.opts.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.opts.dialTimeout)
+		defer cancel()
+	}
+	if target.Transport != "tls" {
+		return l.dial(ctx, "tcp", target.Addr(), ln)
+	}
+
+	config := &tls.Config{}
+	if ln != nil && ln.tlsConfig != nil {
+		config = ln.tlsConfig.Clone()
+	}
+	config.ServerName = target.Host
+
+	d := tls.Dialer{NetDialer: dialer(ln), Config: config}
+	conn, err := d.DialContext(ctx, "tcp", target.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	s := l.serveConn(conn, ln, true)
+	if s == nil {
+		return nil, ErrLayerClosed
+	}
+	return s, nil
+}
+
+// setSentBy fills in the sent-by address of a Via that does not have one.
+func setSentBy(via *sip.Via, host, port string) {
+	if via.Host != "" || host == "" {
+		return
+	}
+
+	via.Host = host
+	if p, _ := strconv.Atoi(port); p != 0 {
+		via.Port = port
+	}
+}
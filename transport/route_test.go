@@ -0,0 +1,298 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/nilssonr/sip/transport/simnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStampVia(t *testing.T) {
+	tests := []struct {
+		Via      string
+		Source   net.Addr
+		Received string
+		Rport    string
+	}{
+		{
+			Via:    "SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1",
+			Source: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060},
+		},
+		{
+			Via:      "SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK1",
+			Source:   &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060},
+			Received: "192.0.2.1",
+		},
+		{
+			Via:      "SIP/2.0/UDP 10.0.0.1:5060;rport;branch=z9hG4bK1",
+			Source:   &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9988},
+			Received: "192.0.2.1",
+			Rport:    "9988",
+		},
+		{
+			Via:      "SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1;rport",
+			Source:   &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060},
+			Received: "192.0.2.1",
+			Rport:    "5060",
+		},
+	}
+
+	for _, test := range tests {
+		msg, err := sip.Parse([]byte("OPTIONS sip:bob@biloxi.com SIP/2.0\r\nVia: " + test.Via + "\r\n\r\n"))
+		assert.Nil(t, err)
+
+		stampVia(msg, test.Source)
+
+		vias, ok := msg.Via()
+		assert.True(t, ok)
+		assert.Equal(t, test.Received, vias[0].Received)
+		assert.Equal(t, test.Rport, vias[0].Rport)
+	}
+}
+
+func TestSendResponseUsesReceivedAndRport(t *testing.T) {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	l := NewLayer()
+	go l.ServePacket(context.Background(), server)
+
+	req := "REGISTER sip:registrar.biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;rport;branch=z9hG4bKnashds7\r\n" +
+		"Call-ID: 843817637684230@998sdasdh09\r\n" +
+		"CSeq: 1826 REGISTER\r\n\r\n"
+	_, err = client.WriteTo([]byte(req), server.LocalAddr())
+	assert.Nil(t, err)
+
+	msg := <-l.Messages()
+	assert.Equal(t, "udp", msg.Transport)
+	assert.Equal(t, client.LocalAddr().String(), msg.Source.String())
+	assert.Equal(t, server.LocalAddr().String(), msg.Destination.String())
+	assert.NotZero(t, msg.ConnID)
+	assert.False(t, msg.ReceivedAt.IsZero())
+
+	assert.Nil(t, l.Send(sip.NewResponse(msg, sip.StatusOK, "")))
+
+	buf := make([]byte, maxPacketSize)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFrom(buf)
+	assert.Nil(t, err)
+
+	res, err := sip.Parse(buf[:n])
+	assert.Nil(t, err)
+	assert.Equal(t, sip.StatusOK, res.StatusCode())
+}
+
+func TestSendToSwitchesLargeRequestsToTCP(t *testing.T) {
+	server := NewLayer()
+	tcpAddr, err := server.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	_, err = server.Listen(context.Background(), "udp", tcpAddr.String())
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+
+	target := Target{Transport: "udp", IP: net.ParseIP("127.0.0.1"), Port: tcpAddr.(*net.TCPAddr).Port}
+
+	tests := []struct {
+		Options   []Option
+		BodySize  int
+		Transport string
+	}{
+		{BodySize: 100, Transport: "udp"},
+		{BodySize: 1400, Transport: "tcp"},
+		{Options: []Option{WithTCPSwitch(false)}, BodySize: 1400, Transport: "udp"},
+		{Options: []Option{WithPathMTU(9000)}, BodySize: 1400, Transport: "udp"},
+	}
+
+	for _, test := range tests {
+		client := NewLayer(test.Options...)
+		_, err := client.Listen(context.Background(), "udp", "127.0.0.1:0")
+		assert.Nil(t, err)
+
+		req, err := sip.Parse([]byte(testRequest))
+		assert.Nil(t, err)
+		req.SetBody(make([]byte, test.BodySize))
+
+		assert.Nil(t, client.SendTo(req, target))
+
+		msg := <-server.Messages()
+		assert.Equal(t, test.Transport, msg.Transport)
+		vias, _ := msg.Via()
+		assert.Equal(t, test.Transport, vias[0].Transport)
+
+		client.Shutdown(context.Background())
+	}
+}
+
+func TestSendToFallsBackToUDP(t *testing.T) {
+	server := NewLayer()
+	addr, err := server.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+
+	client := NewLayer()
+	_, err = client.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Shutdown(context.Background())
+
+	req, err := sip.Parse([]byte(testRequest))
+	assert.Nil(t, err)
+	req.SetBody(make([]byte, 1400))
+
+	target := Target{Transport: "udp", IP: net.ParseIP("127.0.0.1"), Port: addr.(*net.UDPAddr).Port}
+	assert.Nil(t, client.SendTo(req, target))
+
+	msg := <-server.Messages()
+	assert.Equal(t, "udp", msg.Transport)
+}
+
+func TestDialTimeout(t *testing.T) {
+	// The peer accepts the connection but never answers the TLS handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	l := NewLayer(WithDialTimeout(50 * time.Millisecond))
+	defer l.Shutdown(context.Background())
+
+	addr := silent.Addr().(*net.TCPAddr)
+	start := time.Now()
+	_, err = l.dialTarget(context.Background(), Target{Transport: "tls", Host: "biloxi.com", IP: addr.IP, Port: addr.Port}, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSimulatedNetwork(t *testing.T) {
+	clock := simnet.NewFakeClock(time.Now())
+	network := simnet.New(clock, 1)
+	network.SetDefaultLink(simnet.Link{Latency: 20 * time.Millisecond})
+
+	alice, bob := NewLayer(), NewLayer()
+	for host, l := range map[string]*layer{"10.0.0.1": alice, "10.0.0.2": bob} {
+		conn, err := network.ListenPacket(host + ":5060")
+		assert.Nil(t, err)
+		go l.ServePacket(context.Background(), conn)
+	}
+	assert.Eventually(t, func() bool {
+		return len(alice.Listeners()) == 1 && len(bob.Listeners()) == 1
+	}, time.Second, time.Millisecond)
+
+	req, err := sip.Parse([]byte(strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1", "SIP/2.0/UDP 10.0.0.1", 1)))
+	assert.Nil(t, err)
+	target := Target{Transport: "udp", IP: net.ParseIP("10.0.0.2"), Port: 5060}
+	assert.Nil(t, alice.SendTo(req, target))
+
+	clock.Advance(20 * time.Millisecond)
+	msg := <-bob.Messages()
+	assert.Equal(t, "OPTIONS", msg.Method())
+	assert.Equal(t, "10.0.0.1:5060", msg.Source.String())
+
+	network.Partition("10.0.0.1", "10.0.0.2")
+	assert.Nil(t, bob.Send(sip.NewResponse(msg, 200, "OK")))
+	clock.Advance(time.Second)
+	select {
+	case <-alice.Messages():
+		t.Fatal("response crossed a partition")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	network.Heal("10.0.0.1", "10.0.0.2")
+	assert.Nil(t, bob.Send(sip.NewResponse(msg, 200, "OK")))
+	clock.Advance(20 * time.Millisecond)
+	res := <-alice.Messages()
+	assert.Equal(t, 200, res.StatusCode())
+
+	for _, l := range []*layer{alice, bob} {
+		assert.Nil(t, l.Shutdown(context.Background()))
+	}
+}
+
+func TestSendResponseOnRequestConnection(t *testing.T) {
+	l := NewLayer()
+	addr, err := l.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Shutdown(context.Background())
+
+	// Both clients share a host and advertise the same sent-by without
+	// rport.
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", addr.String())
+		assert.Nil(t, err)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	for i, client := range clients {
+		req := strings.Replace(testRequest, "z9hG4bK776asdhds", "z9hG4bK776asdhds"+string(rune('a'+i)), 1)
+		_, err := client.Write([]byte(req))
+		assert.Nil(t, err)
+		msg := <-l.Messages()
+		assert.Nil(t, l.Send(sip.NewResponse(msg, sip.StatusOK, "")))
+	}
+
+	for i, client := range clients {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		b, err := readStreamMessage(bufio.NewReader(client))
+		assert.Nil(t, err)
+		res, err := sip.Parse(b)
+		assert.Nil(t, err)
+		vias, _ := res.Via()
+		assert.Equal(t, "z9hG4bK776asdhds"+string(rune('a'+i)), vias[0].Branch)
+	}
+}
+
+func TestSendResponseReconnects(t *testing.T) {
+	server := NewLayer()
+	addr, err := server.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+
+	client := NewLayer()
+	clientAddr, err := client.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr.String())
+	assert.Nil(t, err)
+	req := strings.Replace(testRequest, "SIP/2.0/TCP 127.0.0.1", "SIP/2.0/TCP "+clientAddr.String(), 1)
+	_, err = conn.Write([]byte(req))
+	assert.Nil(t, err)
+	msg := <-server.Messages()
+
+	// The connection of the request is gone, so the response is sent to the
+	// received address and sent-by port.
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		vias, _ := msg.Via()
+		return server.origins.get(vias[0]) == nil
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, server.Send(sip.NewResponse(msg, sip.StatusOK, "")))
+
+	select {
+	case res := <-client.Messages():
+		assert.Equal(t, sip.StatusOK, res.StatusCode())
+	case <-time.After(time.Second):
+		t.Fatal("response was not delivered")
+	}
+}
@@ -0,0 +1,28 @@
+package simnet
+
+import (
+	"time"
+
+	"github.com/nilssonr/sip/clock"
+)
+
+// Clock tells the time and schedules functions. The network uses it to
+// schedule packet deliveries, so that tests can control time with a FakeClock.
+type Clock = clock.Clock
+
+// Timer is a function scheduled with Clock.AfterFunc.
+type Timer = clock.Timer
+
+// FakeClock is a clock that only moves when Advance is called. It is
+// clock.Fake, kept here for the users of the network.
+type FakeClock = clock.Fake
+
+// RealClock returns a clock backed by the time package.
+func RealClock() Clock {
+	return clock.Real()
+}
+
+// NewFakeClock returns a fake clock that starts at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return clock.NewFake(start)
+}
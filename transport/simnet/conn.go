@@ -0,0 +1,174 @@
+package simnet
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type packet struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+// PacketConn is an endpoint of a simulated network. It implements
+// net.PacketConn with the semantics of a UDP socket: writes never block, and
+// packets that cannot be delivered are silently dropped.
+type PacketConn struct {
+	network *Network
+	addr    *net.UDPAddr
+
+	mu       sync.Mutex
+	queue    []packet
+	ready    chan struct{}
+	closed   chan struct{}
+	isClosed bool
+	deadline chan struct{}
+	timer    *time.Timer
+}
+
+func newPacketConn(n *Network, addr *net.UDPAddr) *PacketConn {
+	return &PacketConn{
+		network: n,
+		addr:    addr,
+		ready:   make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *PacketConn) enqueue(pkt packet) {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return
+	}
+	c.queue = append(c.queue, pkt)
+	c.mu.Unlock()
+
+	c.wake()
+}
+
+func (c *PacketConn) wake() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// ReadFrom reads the next packet delivered to the endpoint. Read deadlines
+// are measured against the wall clock, as for any net.PacketConn.
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		if c.isClosed {
+			c.mu.Unlock()
+			return 0, nil, c.opError("read", net.ErrClosed)
+		}
+		if len(c.queue) > 0 {
+			pkt := c.queue[0]
+			c.queue = c.queue[1:]
+			pending := len(c.queue) > 0
+			c.mu.Unlock()
+
+			if pending {
+				c.wake()
+			}
+			return copy(b, pkt.data), pkt.from, nil
+		}
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		select {
+		case <-deadline:
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		default:
+		}
+
+		select {
+		case <-c.ready:
+		case <-c.closed:
+		case <-deadline:
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// WriteTo sends a packet to addr, which must be a *net.UDPAddr.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", ErrInvalidAddress)
+	}
+
+	c.mu.Lock()
+	closed := c.isClosed
+	c.mu.Unlock()
+	if closed {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	c.network.send(c.addr, to, b)
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return c.opError("close", net.ErrClosed)
+	}
+	c.isClosed = true
+	c.queue = nil
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	close(c.closed)
+	c.mu.Unlock()
+
+	c.network.remove(c)
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Wake blocked readers so that they wait on the new deadline.
+	defer c.wake()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.deadline = nil
+	if t.IsZero() {
+		return nil
+	}
+
+	deadline := make(chan struct{})
+	c.deadline = deadline
+	if d := time.Until(t); d <= 0 {
+		close(deadline)
+	} else {
+		c.timer = time.AfterFunc(d, func() { close(deadline) })
+	}
+	return nil
+}
+
+// SetWriteDeadline has no effect, since writes never block.
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *PacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
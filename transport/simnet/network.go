@@ -0,0 +1,250 @@
+// Package simnet simulates a datagram network in memory, so that SIP
+// endpoints can be tested against latency, jitter, loss, duplication,
+// reordering and partitions without touching real sockets.
+//
+// Endpoints are PacketConns, which implement net.PacketConn and can be served
+// by a transport layer with ServePacket. Packet delivery is scheduled on a
+// Clock; with a FakeClock, nothing arrives until the clock is advanced.
+package simnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAddressInUse   = errors.New("simnet: address already in use")
+	ErrInvalidAddress = errors.New("simnet: invalid address")
+)
+
+// firstEphemeralPort is the first port allocated for endpoints that listen
+// on port 0.
+const firstEphemeralPort = 49152
+
+// Link describes the conditions of the path from one host to another.
+type Link struct {
+	// Latency is the base one-way delay of every packet.
+	Latency time.Duration
+	// Jitter is the largest random delay added to Latency.
+	Jitter time.Duration
+	// Loss is the probability, from 0 to 1, that a packet is dropped.
+	Loss float64
+	// Duplicate is the probability that a packet is delivered twice.
+	Duplicate float64
+	// Reorder is the probability that a packet is held back by ReorderDelay,
+	// letting packets sent after it overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration
+}
+
+// Stats counts packets handled by a network.
+type Stats struct {
+	Sent       uint64
+	Delivered  uint64
+	Lost       uint64
+	Duplicated uint64
+	// Unreachable counts packets sent to an address nobody listens on.
+	Unreachable uint64
+}
+
+// Network is a simulated datagram network. Hosts are identified by IP
+// address; links and partitions apply between hosts, regardless of port.
+type Network struct {
+	clock Clock
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	defaultLink Link
+	links       map[[2]string]Link
+	partitions  map[[2]string]struct{}
+	conns       map[string]*PacketConn
+	nextPort    int
+	stats       Stats
+}
+
+// New returns a network that schedules deliveries on clock. The seed makes
+// the random conditions of the links reproducible.
+func New(clock Clock, seed int64) *Network {
+	if clock == nil {
+		clock = RealClock()
+	}
+
+	return &Network{
+		clock:      clock,
+		rand:       rand.New(rand.NewSource(seed)),
+		links:      map[[2]string]Link{},
+		partitions: map[[2]string]struct{}{},
+		conns:      map[string]*PacketConn{},
+		nextPort:   firstEphemeralPort,
+	}
+}
+
+// Clock returns the clock the network schedules deliveries on.
+func (n *Network) Clock() Clock {
+	return n.clock
+}
+
+// SetDefaultLink sets the conditions of the links that have not been set
+// with SetLink.
+func (n *Network) SetDefaultLink(link Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.defaultLink = link
+}
+
+// SetLink sets the conditions of the path from host from to host to. The
+// reverse path is not affected.
+func (n *Network) SetLink(from, to string, link Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.links[[2]string{from, to}] = link
+}
+
+// Partition drops every packet sent between hosts a and b, in both
+// directions, until Heal is called. Packets already in flight still arrive.
+func (n *Network) Partition(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partitions[[2]string{a, b}] = struct{}{}
+	n.partitions[[2]string{b, a}] = struct{}{}
+}
+
+// Heal removes the partition between hosts a and b.
+func (n *Network) Heal(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.partitions, [2]string{a, b})
+	delete(n.partitions, [2]string{b, a})
+}
+
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.stats
+}
+
+// ListenPacket returns an endpoint bound to address, which must be an IP
+// address and port. Port 0 allocates an unused port.
+func (n *Network) ListenPacket(address string) (*PacketConn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == 0 {
+		for ; n.nextPort <= 65535; n.nextPort++ {
+			addr := &net.UDPAddr{IP: ip, Port: n.nextPort}
+			if _, ok := n.conns[addr.String()]; !ok {
+				port = n.nextPort
+				n.nextPort++
+				break
+			}
+		}
+		if port == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrAddressInUse, address)
+		}
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if _, ok := n.conns[addr.String()]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAddressInUse, addr)
+	}
+
+	c := newPacketConn(n, addr)
+	n.conns[addr.String()] = c
+	return c, nil
+}
+
+func (n *Network) remove(c *PacketConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conns[c.addr.String()] == c {
+		delete(n.conns, c.addr.String())
+	}
+}
+
+// send applies the conditions of the link between the hosts of from and to,
+// and schedules the deliveries of the packet.
+func (n *Network) send(from, to *net.UDPAddr, b []byte) {
+	n.mu.Lock()
+
+	n.stats.Sent++
+	key := [2]string{from.IP.String(), to.IP.String()}
+	if _, ok := n.partitions[key]; ok {
+		n.stats.Lost++
+		n.mu.Unlock()
+		return
+	}
+
+	link, ok := n.links[key]
+	if !ok {
+		link = n.defaultLink
+	}
+	if link.Loss > 0 && n.rand.Float64() < link.Loss {
+		n.stats.Lost++
+		n.mu.Unlock()
+		return
+	}
+
+	copies := 1
+	if link.Duplicate > 0 && n.rand.Float64() < link.Duplicate {
+		copies++
+		n.stats.Duplicated++
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = link.Latency
+		if link.Jitter > 0 {
+			delays[i] += time.Duration(n.rand.Int63n(int64(link.Jitter) + 1))
+		}
+		if link.Reorder > 0 && n.rand.Float64() < link.Reorder {
+			delays[i] += link.ReorderDelay
+		}
+	}
+	n.mu.Unlock()
+
+	pkt := packet{from: from, data: append([]byte(nil), b...)}
+	for _, d := range delays {
+		n.clock.AfterFunc(d, func() {
+			n.deliver(to, pkt)
+		})
+	}
+}
+
+func (n *Network) deliver(to *net.UDPAddr, pkt packet) {
+	n.mu.Lock()
+	c, ok := n.conns[to.String()]
+	if ok {
+		n.stats.Delivered++
+	} else {
+		n.stats.Unreachable++
+	}
+	n.mu.Unlock()
+
+	if ok {
+		c.enqueue(pkt)
+	}
+}
@@ -0,0 +1,172 @@
+package simnet
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newPair(t *testing.T, n *Network) (*PacketConn, *PacketConn) {
+	a, err := n.ListenPacket("10.0.0.1:5060")
+	assert.Nil(t, err)
+	b, err := n.ListenPacket("10.0.0.2:5060")
+	assert.Nil(t, err)
+	return a, b
+}
+
+// queued returns the packets waiting to be read by c, without blocking.
+func queued(c *PacketConn) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var out []string
+	for _, pkt := range c.queue {
+		out = append(out, string(pkt.data))
+	}
+	return out
+}
+
+func TestLatency(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	n := New(clock, 1)
+	n.SetDefaultLink(Link{Latency: 50 * time.Millisecond})
+	a, b := newPair(t, n)
+
+	_, err := a.WriteTo([]byte("hello"), b.LocalAddr())
+	assert.Nil(t, err)
+
+	clock.Advance(49 * time.Millisecond)
+	assert.Empty(t, queued(b))
+
+	clock.Advance(time.Millisecond)
+	buf := make([]byte, 16)
+	size, from, err := b.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:size]))
+	assert.Equal(t, a.LocalAddr(), from)
+}
+
+func TestLossAndDuplication(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	n := New(clock, 1)
+	a, b := newPair(t, n)
+
+	n.SetLink("10.0.0.1", "10.0.0.2", Link{Loss: 1})
+	a.WriteTo([]byte("lost"), b.LocalAddr())
+	clock.Advance(time.Second)
+	assert.Empty(t, queued(b))
+
+	// The reverse direction is not affected.
+	b.WriteTo([]byte("back"), a.LocalAddr())
+	clock.Advance(time.Second)
+	assert.Equal(t, []string{"back"}, queued(a))
+
+	n.SetLink("10.0.0.1", "10.0.0.2", Link{Duplicate: 1})
+	a.WriteTo([]byte("twice"), b.LocalAddr())
+	clock.Advance(time.Second)
+	assert.Equal(t, []string{"twice", "twice"}, queued(b))
+
+	assert.Equal(t, Stats{Sent: 3, Delivered: 3, Lost: 1, Duplicated: 1}, n.Stats())
+}
+
+func TestReorder(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	n := New(clock, 1)
+	a, b := newPair(t, n)
+
+	n.SetLink("10.0.0.1", "10.0.0.2", Link{
+		Latency:      10 * time.Millisecond,
+		Reorder:      1,
+		ReorderDelay: 100 * time.Millisecond,
+	})
+	a.WriteTo([]byte("first"), b.LocalAddr())
+
+	n.SetLink("10.0.0.1", "10.0.0.2", Link{Latency: 10 * time.Millisecond})
+	a.WriteTo([]byte("second"), b.LocalAddr())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, []string{"second", "first"}, queued(b))
+}
+
+func TestPartition(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	n := New(clock, 1)
+	a, b := newPair(t, n)
+
+	n.Partition("10.0.0.1", "10.0.0.2")
+	a.WriteTo([]byte("one"), b.LocalAddr())
+	b.WriteTo([]byte("two"), a.LocalAddr())
+	clock.Advance(time.Second)
+	assert.Empty(t, queued(a))
+	assert.Empty(t, queued(b))
+
+	n.Heal("10.0.0.2", "10.0.0.1")
+	a.WriteTo([]byte("three"), b.LocalAddr())
+	clock.Advance(time.Second)
+	assert.Equal(t, []string{"three"}, queued(b))
+}
+
+func TestJitterIsReproducible(t *testing.T) {
+	arrivals := func() []time.Duration {
+		clock := NewFakeClock(epoch)
+		n := New(clock, 42)
+		n.SetDefaultLink(Link{Latency: 10 * time.Millisecond, Jitter: 20 * time.Millisecond})
+		a, b := newPair(t, n)
+
+		for i := 0; i < 5; i++ {
+			a.WriteTo([]byte("x"), b.LocalAddr())
+		}
+
+		var out []time.Duration
+		for len(out) < 5 {
+			clock.Advance(time.Millisecond)
+			for range queued(b) {
+				b.ReadFrom(make([]byte, 1))
+				out = append(out, clock.Now().Sub(epoch))
+			}
+		}
+		return out
+	}
+
+	first := arrivals()
+	assert.Equal(t, first, arrivals())
+	for _, d := range first {
+		assert.GreaterOrEqual(t, d, 10*time.Millisecond)
+		assert.LessOrEqual(t, d, 30*time.Millisecond)
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	n := New(nil, 1)
+
+	a, err := n.ListenPacket("10.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Equal(t, firstEphemeralPort, a.LocalAddr().(*net.UDPAddr).Port)
+
+	_, err = n.ListenPacket(a.LocalAddr().String())
+	assert.ErrorIs(t, err, ErrAddressInUse)
+	_, err = n.ListenPacket("example.com:5060")
+	assert.ErrorIs(t, err, ErrInvalidAddress)
+
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = a.ReadFrom(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	a.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, _, err := a.ReadFrom(make([]byte, 1))
+		done <- err
+	}()
+	assert.Nil(t, a.Close())
+	assert.ErrorIs(t, <-done, net.ErrClosed)
+
+	// The address can be reused once the endpoint is closed.
+	_, err = n.ListenPacket(a.LocalAddr().String())
+	assert.Nil(t, err)
+}
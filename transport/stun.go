@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+// A minimal STUN codec for the Binding requests that RFC 5626 uses as
+// keepalives on UDP flows.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5389
+// See: https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.2
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+
+	stunAttrXORMappedAddress = 0x0020
+	stunAttrFingerprint      = 0x8028
+
+	stunFingerprintXOR = 0x5354554e
+)
+
+var errInvalidSTUN = errors.New("transport: invalid STUN message")
+
+type stunMessage struct {
+	typ  uint16
+	txID [12]byte
+	// mapped is the XOR-MAPPED-ADDRESS of a Binding response.
+	mapped *net.UDPAddr
+}
+
+// isSTUN reports whether a datagram is a STUN message rather than SIP. STUN
+// messages start with two zero bits and carry the magic cookie, whereas SIP
+// messages start with a printable character.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5389#section-6
+func isSTUN(b []byte) bool {
+	return len(b) >= stunHeaderSize &&
+		b[0]&0xc0 == 0 &&
+		binary.BigEndian.Uint32(b[4:8]) == stunMagicCookie &&
+		int(binary.BigEndian.Uint16(b[2:4]))+stunHeaderSize == len(b)
+}
+
+func newSTUNBindingRequest() *stunMessage {
+	m := &stunMessage{typ: stunBindingRequest}
+	rand.Read(m.txID[:])
+	return m
+}
+
+func parseSTUN(b []byte) (*stunMessage, error) {
+	if !isSTUN(b) {
+		return nil, errInvalidSTUN
+	}
+
+	m := &stunMessage{typ: binary.BigEndian.Uint16(b[0:2])}
+	copy(m.txID[:], b[8:20])
+
+	for pos := stunHeaderSize; pos+4 <= len(b); {
+		typ := binary.BigEndian.Uint16(b[pos : pos+2])
+		length := int(binary.BigEndian.Uint16(b[pos+2 : pos+4]))
+		value := b[pos+4:]
+		if length > len(value) {
+			return nil, errInvalidSTUN
+		}
+		value = value[:length]
+
+		switch typ {
+		case stunAttrXORMappedAddress:
+			addr, err := m.decodeXORAddress(value)
+			if err != nil {
+				return nil, err
+			}
+			m.mapped = addr
+		case stunAttrFingerprint:
+			if length != 4 || binary.BigEndian.Uint32(value) != stunFingerprint(b[:pos]) {
+				return nil, errInvalidSTUN
+			}
+		}
+
+		pos += 4 + (length+3)&^3
+	}
+
+	return m, nil
+}
+
+// marshal encodes the message with a FINGERPRINT attribute.
+func (m *stunMessage) marshal() []byte {
+	b := make([]byte, stunHeaderSize, 64)
+	binary.BigEndian.PutUint16(b[0:2], m.typ)
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	copy(b[8:20], m.txID[:])
+
+	if m.mapped != nil {
+		b = appendSTUNAttr(b, stunAttrXORMappedAddress, m.encodeXORAddress(m.mapped))
+	}
+
+	// The length must include the FINGERPRINT attribute when it is computed.
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-stunHeaderSize+8))
+	fingerprint := make([]byte, 4)
+	binary.BigEndian.PutUint32(fingerprint, stunFingerprint(b))
+	return appendSTUNAttr(b, stunAttrFingerprint, fingerprint)
+}
+
+func appendSTUNAttr(b []byte, typ uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-stunHeaderSize))
+	return b
+}
+
+func stunFingerprint(b []byte) uint32 {
+	return crc32.ChecksumIEEE(b) ^ stunFingerprintXOR
+}
+
+// xorKey is the value that XOR-MAPPED-ADDRESS is masked with: the magic cookie
+// followed by the transaction ID.
+func (m *stunMessage) xorKey() []byte {
+	key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+	return append(key, m.txID[:]...)
+}
+
+func (m *stunMessage) encodeXORAddress(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+
+	b := []byte{0, family}
+	b = binary.BigEndian.AppendUint16(b, uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	key := m.xorKey()
+	for i := range ip {
+		b = append(b, ip[i]^key[i])
+	}
+	return b
+}
+
+func (m *stunMessage) decodeXORAddress(b []byte) (*net.UDPAddr, error) {
+	if len(b) < 4 {
+		return nil, errInvalidSTUN
+	}
+
+	size := net.IPv4len
+	if b[1] == 0x02 {
+		size = net.IPv6len
+	}
+	if len(b) != 4+size {
+		return nil, errInvalidSTUN
+	}
+
+	key := m.xorKey()
+	ip := make(net.IP, size)
+	for i := range ip {
+		ip[i] = b[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(b[2:4]) ^ uint16(stunMagicCookie>>16)
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
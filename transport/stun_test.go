@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSTUNRoundTrip(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.1").To4(), Port: 32853},
+		{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853},
+	} {
+		req := newSTUNBindingRequest()
+		res := &stunMessage{typ: stunBindingResponse, txID: req.txID, mapped: addr}
+
+		b := res.marshal()
+		assert.True(t, isSTUN(b))
+
+		m, err := parseSTUN(b)
+		assert.Nil(t, err)
+		assert.Equal(t, uint16(stunBindingResponse), m.typ)
+		assert.Equal(t, req.txID, m.txID)
+		assert.Equal(t, addr.String(), m.mapped.String())
+
+		b[len(b)-1] ^= 0xff
+		_, err = parseSTUN(b)
+		assert.NotNil(t, err)
+	}
+
+	assert.False(t, isSTUN([]byte(testRequest)))
+}
+
+func TestBinding(t *testing.T) {
+	server := NewLayer()
+	serverAddr, err := server.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Shutdown(context.Background())
+
+	client := NewLayer()
+	clientAddr, err := client.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mapped, err := client.Binding(ctx, serverAddr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, clientAddr.String(), mapped.String())
+}
+
+func TestKeepAlivePacketFlowFailed(t *testing.T) {
+	// A socket that never answers.
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer peer.Close()
+
+	failed := make(chan Flow, 1)
+	client := NewLayer(
+		WithKeepAlive(10*time.Millisecond, 50*time.Millisecond),
+		WithFlowFailed(func(flow Flow, err error) {
+			failed <- flow
+		}),
+	)
+	_, err = client.Listen(context.Background(), "udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer client.Shutdown(context.Background())
+
+	err = client.KeepAlivePacket(context.Background(), peer.LocalAddr().String())
+	assert.ErrorIs(t, err, ErrFlowFailed)
+
+	flow := <-failed
+	assert.Equal(t, "udp", flow.Transport)
+	assert.Equal(t, peer.LocalAddr().String(), flow.RemoteAddr.String())
+}
@@ -1 +1,300 @@
 package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// maxMessageSize is the largest message accepted on a stream connection.
+// Connections that exceed it are closed since they cannot be resynchronised.
+const maxMessageSize = 65535
+
+func (l *layer) serveStream(ctx context.Context, listener net.Listener, ln *Listener) error {
+	network := listener.Addr().Network()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if l.isClosing() {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			l.reportError(ErrorKindAccept, network, nil, err)
+			return err
+		}
+
+		if !l.admitSource(conn.RemoteAddr(), false) || !l.admitConn(ln, conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
+		if l.serveConn(conn, ln, false) == nil {
+			return nil
+		}
+	}
+}
+
+// stream is a connection-oriented flow to a peer.
+type stream struct {
+	net.Conn
+
+	id       uint64
+	outbound bool
+	// listener is the listener the connection was accepted on or opened
+	// from, if any.
+	listener *Listener
+	// pong receives a value for every keepalive pong read from the peer.
+	pong chan struct{}
+	// done is closed when the reader stops.
+	done chan struct{}
+}
+
+func newStream(conn net.Conn, id uint64, ln *Listener, outbound bool) *stream {
+	return &stream{
+		Conn:     conn,
+		id:       id,
+		outbound: outbound,
+		listener: ln,
+		pong:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// dial opens an outbound stream connection and starts reading from it. When
+// ln is set the connection is opened from its address.
+func (l *layer) dial(ctx context.Context, network, address string, ln *Listener) (*stream, error) {
+	conn, err := dialer(ln).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := l.serveConn(conn, ln, true)
+	if s == nil {
+		return nil, ErrLayerClosed
+	}
+	return s, nil
+}
+
+// dialer returns a dialer that binds connections to the address of ln.
+func dialer(ln *Listener) *net.Dialer {
+	var d net.Dialer
+	if ln != nil {
+		if ip := addrIP(ln.Addr); ip != nil && !ip.IsUnspecified() {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return &d
+}
+
+// readStream reads messages from conn until it is closed. A message that fails
+// to parse is answered or dropped and reading continues with the next message,
+// since Content-Length framing keeps the stream in sync. Framing and read
+// errors close the connection.
+func (l *layer) readStream(conn *stream) {
+	defer l.wg.Done()
+	defer l.removeConn(conn)
+
+	network := transportName(conn.Conn)
+	reader := bufio.NewReader(conn)
+
+	for {
+		f, b, err := readStreamFrame(reader, conn.outbound)
+		switch f {
+		case framePing:
+			if _, err := conn.Write(crlf); err != nil {
+				l.reportError(ErrorKindWrite, network, conn.RemoteAddr(), err)
+				return
+			}
+			continue
+		case framePong:
+			select {
+			case conn.pong <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		if err != nil {
+			if l.isClosing() {
+				return
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrInvalidContentLength) {
+				l.reportError(ErrorKindFraming, network, conn.RemoteAddr(), err)
+				return
+			}
+			l.reportError(ErrorKindRead, network, conn.RemoteAddr(), err)
+			return
+		}
+
+		if !l.admitSource(conn.RemoteAddr(), true) {
+			continue
+		}
+
+		receivedAt := time.Now()
+
+		msg, err := sip.Parse(b)
+		if err != nil {
+			l.handleInvalid(network, conn.RemoteAddr(), conn, msg, err)
+			continue
+		}
+		if !l.admitMessage(conn.RemoteAddr(), msg) {
+			continue
+		}
+
+		if sip.IsRequest(msg) {
+			stampVia(msg, conn.RemoteAddr())
+			if vias, ok := msg.Via(); ok && msg.Method() != sip.MethodAck {
+				l.origins.add(vias[0], conn, receivedAt)
+			}
+		}
+		if !l.admitACL(conn.listener, conn.RemoteAddr(), msg) {
+			continue
+		}
+		if sip.IsRequest(msg) {
+			l.addAlias(conn, msg)
+		}
+
+		l.deliver(&Message{
+			Message:          msg,
+			Source:           conn.RemoteAddr(),
+			Destination:      conn.LocalAddr(),
+			Transport:        network,
+			Listener:         conn.listener,
+			ConnID:           conn.id,
+			PeerCertificates: peerCertificates(conn.Conn),
+			ReceivedAt:       receivedAt,
+		})
+	}
+}
+
+var (
+	crlf       = []byte("\r\n")
+	doubleCRLF = []byte("\r\n\r\n")
+)
+
+// frame is the kind of data read from a stream.
+type frame int
+
+const (
+	frameMessage frame = iota
+	// framePing is a double CRLF keepalive ping.
+	framePing
+	// framePong is a single CRLF keepalive pong.
+	framePong
+)
+
+// readStreamFrame reads the next keepalive or message from a stream. On
+// connections we initiated a lone CRLF is the pong to our ping, on other
+// connections a double CRLF is a ping that must be answered and a lone CRLF
+// preceding a start line is ignored.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.1
+func readStreamFrame(r *bufio.Reader, outbound bool) (frame, []byte, error) {
+	var crlfs int
+
+	for {
+		if b, err := r.Peek(2); err == nil && bytes.Equal(b, crlf) {
+			r.Discard(2)
+			if outbound {
+				return framePong, nil, nil
+			}
+			if crlfs++; crlfs == 2 {
+				return framePing, nil, nil
+			}
+			continue
+		}
+
+		b, err := readStreamMessage(r)
+		return frameMessage, b, err
+	}
+}
+
+// readStreamMessage reads the header section of the next message up to the
+// empty line and then as many body bytes as given by Content-Length. Empty
+// lines preceding the start line are skipped.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc3261#section-18.3
+func readStreamMessage(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+
+	for {
+		line, err := r.ReadSlice('\n')
+		if buf.Len()+len(line) > maxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		buf.Write(line)
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && buf.Len() > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if len(bytes.TrimRight(buf.Bytes(), "\r\n")) == 0 {
+			buf.Reset()
+			continue
+		}
+		if bytes.HasSuffix(buf.Bytes(), doubleCRLF) {
+			break
+		}
+	}
+
+	length, err := contentLength(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len()+length > maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// contentLength finds the Content-Length header field in a header section. A
+// missing header field means that there is no body.
+func contentLength(header []byte) (int, error) {
+	for _, line := range bytes.Split(header, []byte("\r\n")) {
+		name, value, ok := strings.Cut(string(line), ":")
+		if !ok {
+			continue
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "content-length" && name != "l" {
+			continue
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || length < 0 {
+			return 0, ErrInvalidContentLength
+		}
+		return length, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadStreamMessage(t *testing.T) {
+	input := "\r\n" +
+		"MESSAGE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Content-Length: 5\r\n\r\n" +
+		"hello" +
+		"OPTIONS sip:bob@biloxi.com SIP/2.0\r\n" +
+		"l: 0\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(input))
+
+	b, err := readStreamMessage(r)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "MESSAGE"))
+	assert.True(t, strings.HasSuffix(string(b), "\r\n\r\nhello"))
+
+	b, err = readStreamMessage(r)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "OPTIONS"))
+
+	_, err = readStreamMessage(r)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadStreamMessageInvalidContentLength(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("OPTIONS sip:bob@biloxi.com SIP/2.0\r\nContent-Length: x\r\n\r\n"))
+
+	_, err := readStreamMessage(r)
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+}
+
+func TestReadStreamAnswersMalformedRequest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	l := NewLayer()
+	go l.Serve(context.Background(), listener)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("OPTIONS sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP 127.0.0.1;branch=z9hG4bK776asdhds\r\n" +
+		"To: <sip:bob@biloxi.com>\r\n" +
+		"From: <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 63104 OPTIONS\r\n" +
+		"Max-Forwards: seventy\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	assert.Nil(t, err)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := readStreamMessage(bufio.NewReader(client))
+	assert.Nil(t, err)
+
+	res, err := sip.Parse(b)
+	assert.Nil(t, err)
+	assert.Equal(t, sip.StatusBadRequest, res.StatusCode())
+
+	err = <-l.Errors()
+	assert.Equal(t, ErrorKindParse, err.(*Error).Kind)
+	assert.Equal(t, uint64(1), l.Stats().Rejected)
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/nilssonr/sip/sip"
+)
+
+// maxPacketSize is the largest datagram that can be received.
+const maxPacketSize = 65535
+
+// socket is a datagram socket the layer listens on.
+type socket struct {
+	net.PacketConn
+
+	id       uint64
+	listener *Listener
+}
+
+func (l *layer) servePacket(ctx context.Context, conn *socket) error {
+	network := networkName(conn.LocalAddr().Network())
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if l.isClosing() {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			l.reportError(ErrorKindRead, network, addr, err)
+			return err
+		}
+
+		if !l.admitSource(addr, true) || !l.admitConn(conn.listener, addr) {
+			continue
+		}
+
+		if isSTUN(buf[:n]) {
+			l.handleSTUN(conn, addr, buf[:n])
+			continue
+		}
+
+		receivedAt := time.Now()
+		l.peers.add(addr, conn, receivedAt)
+
+		msg, err := sip.Parse(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			l.handleInvalid(network, addr, nil, msg, err)
+			continue
+		}
+		if !l.admitMessage(addr, msg) {
+			continue
+		}
+
+		if sip.IsRequest(msg) {
+			stampVia(msg, addr)
+		}
+		if !l.admitACL(conn.listener, addr, msg) {
+			continue
+		}
+
+		l.deliver(&Message{
+			Message:     msg,
+			Source:      addr,
+			Destination: conn.LocalAddr(),
+			Transport:   network,
+			Listener:    conn.listener,
+			ConnID:      conn.id,
+			ReceivedAt:  receivedAt,
+		})
+	}
+}